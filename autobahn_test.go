@@ -0,0 +1,242 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The cases below reimplement the core of the Autobahn TestSuite
+// fuzzingclient (sections 1 to 7) against an in-process echo server. Run
+// cmd/echoserver for the full suite.
+
+type autobahnCase struct {
+	id   string
+	send []*Frame
+	// echo lists the frames the server must answer with, in order, before
+	// its close frame with code close.
+	echo  []*Frame
+	close int
+}
+
+func text(p string) *Frame {
+	return &Frame{FIN: true, OpCode: TextMessage, Payload: []byte(p)}
+}
+
+func bin(p []byte) *Frame {
+	return &Frame{FIN: true, OpCode: BinaryMessage, Payload: p}
+}
+
+func ping(p string) *Frame {
+	return &Frame{FIN: true, OpCode: PingMessage, Payload: []byte(p)}
+}
+
+func pong(p string) *Frame {
+	return &Frame{FIN: true, OpCode: PongMessage, Payload: []byte(p)}
+}
+
+func closeFrame(code int, reason string) *Frame {
+	return &Frame{FIN: true, OpCode: CloseMessage, Payload: formatCloseMessage(code, reason)}
+}
+
+func normal() *Frame {
+	return closeFrame(CloseNormalClosure, "")
+}
+
+func fragment(opcode byte, fin bool, p string) *Frame {
+	return &Frame{FIN: fin, OpCode: opcode, Payload: []byte(p)}
+}
+
+func autobahnCases() []autobahnCase {
+	var cases []autobahnCase
+
+	// 1: framing of text and binary messages of every length encoding.
+	for i, n := range []int{0, 125, 126, 127, 128, 65535, 65536} {
+		p := strings.Repeat("*", n)
+		cases = append(cases,
+			autobahnCase{"1.1." + strconv.Itoa(i+1), []*Frame{text(p), normal()}, []*Frame{text(p)}, CloseNormalClosure},
+			autobahnCase{"1.2." + strconv.Itoa(i+1), []*Frame{bin([]byte(p)), normal()}, []*Frame{bin([]byte(p))}, CloseNormalClosure})
+	}
+
+	// 2: pings and pongs.
+	cases = append(cases,
+		autobahnCase{"2.1", []*Frame{ping(""), normal()}, []*Frame{pong("")}, CloseNormalClosure},
+		autobahnCase{"2.2", []*Frame{ping("Hello, world!"), normal()}, []*Frame{pong("Hello, world!")}, CloseNormalClosure},
+		autobahnCase{"2.3", []*Frame{ping("\x00\xff\xfe\xfd\xfc\xfb\x00\xff"), normal()}, []*Frame{pong("\x00\xff\xfe\xfd\xfc\xfb\x00\xff")}, CloseNormalClosure},
+		autobahnCase{"2.4", []*Frame{ping(strings.Repeat("\xfe", 125)), normal()}, []*Frame{pong(strings.Repeat("\xfe", 125))}, CloseNormalClosure},
+		autobahnCase{"2.5", []*Frame{ping(strings.Repeat("\xfe", 126)), normal()}, nil, CloseProtocolError},
+		autobahnCase{"2.6", []*Frame{pong("unsolicited"), text("after pong"), normal()}, []*Frame{text("after pong")}, CloseNormalClosure},
+	)
+	var pings, pongs []*Frame
+	for i := 0; i < 10; i++ {
+		pings = append(pings, ping("payload-"+strconv.Itoa(i)))
+		pongs = append(pongs, pong("payload-"+strconv.Itoa(i)))
+	}
+	cases = append(cases, autobahnCase{"2.10", append(pings, normal()), pongs, CloseNormalClosure})
+
+	// 3: reserved bits.
+	rsv := func(bits [3]bool, f *Frame) *Frame {
+		f.RSV = bits
+		return f
+	}
+	cases = append(cases,
+		autobahnCase{"3.1", []*Frame{rsv([3]bool{false, true}, text("Hello")), normal()}, nil, CloseProtocolError},
+		autobahnCase{"3.2", []*Frame{text("Hello"), rsv([3]bool{false, true, true}, text("Hello")), ping("")}, []*Frame{text("Hello")}, CloseProtocolError},
+		autobahnCase{"3.4", []*Frame{rsv([3]bool{false, false, true}, bin([]byte{0xff})), normal()}, nil, CloseProtocolError},
+		autobahnCase{"3.6", []*Frame{rsv([3]bool{true, true}, ping("Hello")), normal()}, nil, CloseProtocolError},
+		autobahnCase{"3.7", []*Frame{rsv([3]bool{true, true, true}, closeFrame(CloseNormalClosure, ""))}, nil, CloseProtocolError},
+	)
+
+	// 4: reserved opcodes.
+	for i, opcode := range []byte{3, 4, 5, 6, 7} {
+		cases = append(cases, autobahnCase{"4.1." + strconv.Itoa(i+1), []*Frame{text("Hello"), {FIN: true, OpCode: opcode}, ping("")}, []*Frame{text("Hello")}, CloseProtocolError})
+	}
+	for i, opcode := range []byte{11, 12, 13, 14, 15} {
+		cases = append(cases, autobahnCase{"4.2." + strconv.Itoa(i+1), []*Frame{text("Hello"), {FIN: true, OpCode: opcode}, ping("")}, []*Frame{text("Hello")}, CloseProtocolError})
+	}
+
+	// 5: fragmentation.
+	cases = append(cases,
+		autobahnCase{"5.1", []*Frame{fragment(PingMessage, false, "frag1"), fragment(ContinuationMessage, true, "frag2"), normal()}, nil, CloseProtocolError},
+		autobahnCase{"5.3", []*Frame{fragment(TextMessage, false, "frag1"), fragment(ContinuationMessage, true, "frag2"), normal()}, []*Frame{text("frag1frag2")}, CloseNormalClosure},
+		autobahnCase{"5.6", []*Frame{fragment(TextMessage, false, "frag1"), ping("ping"), fragment(ContinuationMessage, true, "frag2"), normal()}, []*Frame{pong("ping"), text("frag1frag2")}, CloseNormalClosure},
+		autobahnCase{"5.9", []*Frame{fragment(ContinuationMessage, true, "fragment"), text("Hello"), normal()}, nil, CloseProtocolError},
+		autobahnCase{"5.15", []*Frame{fragment(TextMessage, false, "f1"), fragment(ContinuationMessage, true, "f2"), fragment(ContinuationMessage, false, "f3"), fragment(TextMessage, true, "f4")}, []*Frame{text("f1f2")}, CloseProtocolError},
+		autobahnCase{"5.18", []*Frame{fragment(TextMessage, false, "f1"), fragment(TextMessage, true, "f2"), normal()}, nil, CloseProtocolError},
+		autobahnCase{"5.19", []*Frame{
+			fragment(TextMessage, false, "f1"), fragment(ContinuationMessage, false, "f2"), ping("p1"),
+			fragment(ContinuationMessage, false, "f3"), ping("p2"), fragment(ContinuationMessage, true, "f4"), normal(),
+		}, []*Frame{pong("p1"), pong("p2"), text("f1f2f3f4")}, CloseNormalClosure},
+	)
+
+	// 6: UTF-8 handling, whole and split at every byte.
+	valid := "\xce\xba\xe1\xbd\xb9\xcf\x83\xce\xbc\xce\xb5"
+	invalid := valid + "\xed\xa0\x80edited"
+	cases = append(cases,
+		autobahnCase{"6.1.1", []*Frame{text(""), normal()}, []*Frame{text("")}, CloseNormalClosure},
+		autobahnCase{"6.2.1", []*Frame{text("Hello-\xc2\xb5@\xc3\x9f\xc3\xb6\xc3\xa4\xc3\xbc\xc3\xa0\xc3\xa1-UTF-8!!"), normal()}, []*Frame{text("Hello-\xc2\xb5@\xc3\x9f\xc3\xb6\xc3\xa4\xc3\xbc\xc3\xa0\xc3\xa1-UTF-8!!")}, CloseNormalClosure},
+		autobahnCase{"6.2.3", append(splitText(valid), normal()), []*Frame{text(valid)}, CloseNormalClosure},
+		autobahnCase{"6.3.1", []*Frame{text(invalid), normal()}, nil, CloseInvalidFramePayloadData},
+		autobahnCase{"6.3.2", append(splitText(invalid), normal()), nil, CloseInvalidFramePayloadData},
+		autobahnCase{"6.4.1", []*Frame{fragment(TextMessage, false, valid+"\xf4\x90\x80\x80")}, nil, CloseInvalidFramePayloadData},
+		autobahnCase{"6.6.1", []*Frame{text("\xce"), normal()}, nil, CloseInvalidFramePayloadData},
+	)
+	for i, p := range []string{"\xc0\xaf", "\xe0\x80\xaf", "\xf8\x80\x80\x80\xaf", "\xed\xbf\xbf", "\xef\xbf\xbe"} {
+		f := []*Frame{text(p), normal()}
+		if i == 4 {
+			// Noncharacters are valid UTF-8.
+			cases = append(cases, autobahnCase{"6.x." + strconv.Itoa(i+1), f, []*Frame{text(p)}, CloseNormalClosure})
+			continue
+		}
+		cases = append(cases, autobahnCase{"6.x." + strconv.Itoa(i+1), f, nil, CloseInvalidFramePayloadData})
+	}
+
+	// 7: the closing handshake.
+	cases = append(cases,
+		autobahnCase{"7.1.1", []*Frame{text("Hello World!"), normal()}, []*Frame{text("Hello World!")}, CloseNormalClosure},
+		autobahnCase{"7.1.3", []*Frame{normal(), ping("too late")}, nil, CloseNormalClosure},
+		autobahnCase{"7.1.4", []*Frame{normal(), text("too late")}, nil, CloseNormalClosure},
+		autobahnCase{"7.3.1", []*Frame{{FIN: true, OpCode: CloseMessage}}, nil, CloseNoStatusReceived},
+		autobahnCase{"7.3.2", []*Frame{{FIN: true, OpCode: CloseMessage, Payload: []byte{0x03}}}, nil, CloseProtocolError},
+		autobahnCase{"7.3.3", []*Frame{closeFrame(CloseNormalClosure, "")}, nil, CloseNormalClosure},
+		autobahnCase{"7.3.4", []*Frame{closeFrame(CloseNormalClosure, "Hello World!")}, nil, CloseNormalClosure},
+		autobahnCase{"7.3.5", []*Frame{closeFrame(CloseNormalClosure, strings.Repeat("*", 123))}, nil, CloseNormalClosure},
+		autobahnCase{"7.3.6", []*Frame{closeFrame(CloseNormalClosure, strings.Repeat("*", 124))}, nil, CloseProtocolError},
+		autobahnCase{"7.5.1", []*Frame{closeFrame(CloseNormalClosure, invalid)}, nil, CloseInvalidFramePayloadData},
+	)
+	for i, code := range []int{1000, 1001, 1002, 1003, 1007, 1008, 1009, 1010, 1011, 3000, 3999, 4000, 4999} {
+		cases = append(cases, autobahnCase{"7.7." + strconv.Itoa(i+1), []*Frame{closeFrame(code, "")}, nil, code})
+	}
+	for i, code := range []int{0, 999, 1004, 1005, 1006, 1016, 1100, 2000, 2999} {
+		cases = append(cases, autobahnCase{"7.9." + strconv.Itoa(i+1), []*Frame{closeFrame(code, "")}, nil, CloseProtocolError})
+	}
+	return cases
+}
+
+// splitText sends p as a text message with one byte per fragment.
+func splitText(p string) []*Frame {
+	frames := make([]*Frame, len(p))
+	for i := 0; i < len(p); i++ {
+		frames[i] = fragment(ContinuationMessage, i == len(p)-1, p[i:i+1])
+	}
+	frames[0].OpCode = TextMessage
+	return frames
+}
+
+// runAutobahnCase plays c against a server Conn running echoHandler and
+// returns a description of the first deviation, or "".
+func runAutobahnCase(c autobahnCase) string {
+	client, server := newTestConnPair()
+	defer client.Close()
+	defer server.Close()
+	go echoHandler(server, nil)
+	for _, f := range c.send {
+		f.Mask = true
+		f.MaskingKey = [4]byte{0x37, 0xfa, 0x21, 0x3d}
+	}
+	writeTestFrames(client.Conn, c.send...)
+	client.Conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var got []*Frame
+	var partial *Frame
+	for {
+		frame, err := readFrame(client.br)
+		if err != nil {
+			return "no close frame: " + err.Error()
+		}
+		if frame.Mask {
+			return "masked frame from server"
+		}
+		if frame.OpCode == CloseMessage {
+			code := CloseNoStatusReceived
+			if len(frame.Payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(frame.Payload))
+			}
+			if code != c.close {
+				return "close code " + strconv.Itoa(code)
+			}
+			break
+		}
+		// The echo server may fragment; reassemble before comparing.
+		if frame.OpCode == ContinuationMessage && partial != nil {
+			partial.Payload = append(partial.Payload, frame.Payload...)
+			partial.FIN = frame.FIN
+		} else if !isControl(frame.OpCode) {
+			partial = frame
+		} else {
+			got = append(got, frame)
+			continue
+		}
+		if partial.FIN {
+			got = append(got, partial)
+			partial = nil
+		}
+	}
+	if len(got) != len(c.echo) {
+		return "got " + strconv.Itoa(len(got)) + " frames, want " + strconv.Itoa(len(c.echo))
+	}
+	for i, f := range got {
+		if f.OpCode != c.echo[i].OpCode || !bytes.Equal(f.Payload, c.echo[i].Payload) {
+			return "frame " + strconv.Itoa(i) + " differs"
+		}
+	}
+	return ""
+}
+
+func TestAutobahn(t *testing.T) {
+	cases := autobahnCases()
+	passed := 0
+	for _, c := range cases {
+		t.Run(c.id, func(t *testing.T) {
+			if msg := runAutobahnCase(c); msg != "" {
+				t.Error(msg)
+				return
+			}
+			passed++
+		})
+	}
+	t.Logf("autobahn: %d of %d cases passed", passed, len(cases))
+}
@@ -1,7 +1,8 @@
-package main
+package websocket
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"errors"
 	"net"
@@ -9,18 +10,113 @@ import (
 	"net/url"
 	urlpkg "net/url"
 	"strings"
+	"time"
 )
 
+var (
+	ErrBadScheme      = errors.New("unsupported URL scheme")
+	ErrBadSubprotocol = errors.New("server selected a subprotocol that was not offered")
+)
+
+// Phases of ConnectContext reported by ConnectError.
+const (
+	PhaseDNS   = "dns"
+	PhaseTCP   = "tcp"
+	PhaseProxy = "proxy"
+	PhaseTLS   = "tls"
+	PhaseHTTP  = "http"
+)
+
+// ConnectError is returned by ConnectContext when a phase of the
+// connection setup fails or is cut short by the context.
+type ConnectError struct {
+	Phase string
+	Err   error
+}
+
+func (e *ConnectError) Error() string {
+	return "connect " + e.Phase + ": " + e.Err.Error()
+}
+
+func (e *ConnectError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout reports whether the phase failed because time ran out.
+func (e *ConnectError) Timeout() bool {
+	if errors.Is(e.Err, context.DeadlineExceeded) {
+		return true
+	}
+	var nerr net.Error
+	return errors.As(e.Err, &nerr) && nerr.Timeout()
+}
+
+// phaseError wraps err for phase, preferring the context's error when the
+// context is what cut the phase short.
+func phaseError(ctx context.Context, phase string, err error) error {
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return &ConnectError{Phase: phase, Err: err}
+}
+
 type Client struct {
 	URL *url.URL
 
+	// Header is sent with the upgrade request. NewClient sets Origin to
+	// the http or https origin of the URL; set or delete it to present a
+	// different origin to the server.
 	Header http.Header
 	Dialer *net.Dialer
 	Config *tls.Config
 
+	// Proxy returns the proxy to connect through, or nil for a direct
+	// connection. http, https, socks5 and socks5h proxies are supported.
+	// If Proxy is nil, the proxy is taken from the environment as in
+	// http.ProxyFromEnvironment.
+	Proxy func(*url.URL) (*url.URL, error)
+
+	// HandshakeTimeout bounds ConnectContext from DNS lookup to the end
+	// of the HTTP upgrade. Zero means no timeout beyond the context.
+	HandshakeTimeout time.Duration
+
+	// PingInterval enables a keepalive loop that pings the server at this
+	// interval. PongTimeout is how long to wait for the answering pong
+	// before the connection is closed; zero disables the check.
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+
+	// IdleTimeout bounds the wait for the next frame from the server, and
+	// ReadTimeout the time to receive a frame once it has started.
+	// WriteTimeout bounds sending each frame. Expiry is reported as
+	// ErrIdleTimeout, ErrReadTimeout or ErrWriteTimeout. Zero means no
+	// timeout.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+
+	// MaxFrameSize and MaxMessageSize limit the payload of a single frame
+	// and of a reassembled message read from the server, see
+	// Conn.SetFrameLimit and Conn.SetReadLimit. Zero means no limit.
+	MaxFrameSize   int64
+	MaxMessageSize int64
+
+	// SkipUTF8Validation stops text messages and close reasons from being
+	// checked for valid UTF-8. Only set it for a trusted server.
+	SkipUTF8Validation bool
+
+	// EnableCompression offers the permessage-deflate extension (RFC 7692)
+	// with CompressionParams. The server's response must honour them.
+	EnableCompression bool
+	CompressionParams CompressionParams
+
+	// Subprotocols are offered to the server in order of preference. The
+	// one it selects is reported by Conn.Subprotocol.
+	Subprotocols []string
+
 	Response *http.Response
 
-	Conn net.Conn
+	Conn *Conn
 }
 
 func NewClient(url string) (*Client, error) {
@@ -28,17 +124,20 @@ func NewClient(url string) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
-	nonce, err := genNonce()
+	secure, err := isSecureScheme(u.Scheme)
 	if err != nil {
 		return nil, err
 	}
+	origin := "http://" + u.Host
+	if secure {
+		origin = "https://" + u.Host
+	}
 	header := http.Header{}
 	header.Set("Connection", "Upgrade")
 	header.Set("Upgrade", "websocket")
-	header.Set("Origin", "http://"+u.Host)
+	header.Set("Origin", origin)
 	header.Set("Host", u.Host)
 	header.Set("Sec-WebSocket-Version", "13")
-	header.Set("Sec-WebSocket-Key", nonce)
 	return &Client{
 		URL:    u,
 		Header: header,
@@ -46,69 +145,249 @@ func NewClient(url string) (*Client, error) {
 }
 
 func (cli *Client) Connect() error {
-	var err error
+	return cli.ConnectContext(context.Background())
+}
+
+// ConnectContext dials the server and performs the opening handshake.
+// ctx and HandshakeTimeout bound the whole exchange: DNS lookup, TCP
+// connect, TLS handshake and the HTTP upgrade. Failures in those phases
+// are reported as a *ConnectError.
+func (cli *Client) ConnectContext(ctx context.Context) error {
+	if cli.HandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cli.HandshakeTimeout)
+		defer cancel()
+	}
+	conn, err := cli.dial(ctx)
+	if err != nil {
+		return err
+	}
+
+	stop := watchContext(ctx, conn)
+	err = cli.handshake(conn)
+	stop()
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return &ConnectError{Phase: PhaseHTTP, Err: ctx.Err()}
+		}
+		return err
+	}
+	cli.Conn.startKeepalive(cli.PingInterval, cli.PongTimeout)
+	return nil
+}
+
+// watchContext makes blocked I/O on conn fail once ctx is done. The
+// returned function stops watching and clears the deadline.
+func watchContext(ctx context.Context, conn net.Conn) func() {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+		conn.SetDeadline(time.Time{})
+	}
+}
+
+// isSecureScheme reports whether scheme uses TLS. http and https are
+// accepted as aliases of ws and wss.
+func isSecureScheme(scheme string) (bool, error) {
+	switch strings.ToLower(scheme) {
+	case "ws", "http":
+		return false, nil
+	case "wss", "https":
+		return true, nil
+	}
+	return false, ErrBadScheme
+}
+
+// hostPort returns the host and port to dial, filling in the default
+// port of the scheme.
+func (cli *Client) hostPort() (host, port string, secure bool, err error) {
+	secure, err = isSecureScheme(cli.URL.Scheme)
+	if err != nil {
+		return "", "", false, err
+	}
+	host, port = cli.URL.Hostname(), cli.URL.Port()
+	if port == "" {
+		port = "80"
+		if secure {
+			port = "443"
+		}
+	}
+	return host, port, secure, nil
+}
+
+// dial connects to the server, directly or through the proxy returned by
+// Proxy, and completes the TLS handshake for wss.
+func (cli *Client) dial(ctx context.Context) (net.Conn, error) {
 	if cli.Dialer == nil {
 		cli.Dialer = &net.Dialer{}
 	}
-	switch cli.URL.Scheme {
-	case "ws":
-		cli.Conn, err = cli.Dialer.Dial("tcp", cli.URL.Host)
-	case "wss":
-		cli.Conn, err = tls.DialWithDialer(cli.Dialer, "tcp", cli.URL.Host, cli.Config)
+	host, port, secure, err := cli.hostPort()
+	if err != nil {
+		return nil, err
 	}
+	proxyURL, err := cli.proxyURL()
 	if err != nil {
-		return err
+		return nil, &ConnectError{Phase: PhaseProxy, Err: err}
 	}
+	var conn net.Conn
+	if proxyURL != nil {
+		conn, err = cli.dialProxy(ctx, proxyURL, net.JoinHostPort(host, port))
+	} else {
+		conn, err = cli.dialDirect(ctx, host, port)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !secure {
+		return conn, nil
+	}
+	config := &tls.Config{}
+	if cli.Config != nil {
+		config = cli.Config.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, phaseError(ctx, PhaseTLS, err)
+	}
+	return tlsConn, nil
+}
 
-	bw := bufio.NewWriter(cli.Conn)
-	bw.WriteString("GET " + cli.URL.Path + " HTTP/1.1\r\n")
+// dialDirect resolves host and connects to the first address that
+// accepts.
+func (cli *Client) dialDirect(ctx context.Context, host, port string) (net.Conn, error) {
+	var err error
+	addrs := []string{host}
+	if net.ParseIP(host) == nil {
+		resolver := cli.Dialer.Resolver
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+		addrs, err = resolver.LookupHost(ctx, host)
+		if err != nil {
+			return nil, phaseError(ctx, PhaseDNS, err)
+		}
+	}
+	var conn net.Conn
+	for _, addr := range addrs {
+		conn, err = cli.Dialer.DialContext(ctx, "tcp", net.JoinHostPort(addr, port))
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, phaseError(ctx, PhaseTCP, err)
+	}
+	return conn, nil
+}
+
+// handshake sends the upgrade request on conn and validates the response.
+// Every attempt uses a fresh Sec-WebSocket-Key.
+func (cli *Client) handshake(conn net.Conn) error {
+	nonce, err := genNonce()
+	if err != nil {
+		return err
+	}
+	cli.Header.Set("Sec-WebSocket-Key", nonce)
+	if cli.EnableCompression {
+		ext, err := cli.CompressionParams.offer()
+		if err != nil {
+			return err
+		}
+		cli.Header.Set("Sec-WebSocket-Extensions", ext)
+	}
+	if len(cli.Subprotocols) > 0 {
+		cli.Header.Set("Sec-WebSocket-Protocol", strings.Join(cli.Subprotocols, ", "))
+	}
+	bw := bufio.NewWriter(conn)
+	bw.WriteString("GET " + cli.URL.RequestURI() + " HTTP/1.1\r\n")
 	cli.Header.Write(bw)
 
 	bw.WriteString("\r\n")
 	err = bw.Flush()
 	if err != nil {
-		cli.Close()
-		return err
+		return &ConnectError{Phase: PhaseHTTP, Err: err}
 	}
-	br := bufio.NewReader(cli.Conn)
+	br := bufio.NewReader(conn)
 	cli.Response, err = http.ReadResponse(br, &http.Request{Method: "GET"})
 	if err != nil {
-		cli.Close()
-		return err
+		return &ConnectError{Phase: PhaseHTTP, Err: err}
 	}
 	if cli.Response.StatusCode != 101 {
-		cli.Close()
 		return errors.New("bad status")
 	}
-	if strings.ToLower(cli.Response.Header.Get("Connection")) != "upgrade" ||
-		strings.ToLower(cli.Response.Header.Get("Upgrade")) != "websocket" {
-		cli.Close()
+	if !hasToken(cli.Response.Header, "Connection", "upgrade") ||
+		!hasToken(cli.Response.Header, "Upgrade", "websocket") {
 		return errors.New("bad upgrade")
 	}
 	nonceAccept, err := genNonceAccept(cli.Header.Get("Sec-WebSocket-Key"))
 	if err != nil {
-		cli.Close()
 		return err
 	}
 	if cli.Response.Header.Get("Sec-Websocket-Accept") != string(nonceAccept) {
-		cli.Close()
 		return errors.New("mismatch challenge/response")
 	}
+	subprotocol := cli.Response.Header.Get("Sec-WebSocket-Protocol")
+	if subprotocol != "" && !cli.offered(subprotocol) {
+		return ErrBadSubprotocol
+	}
+	params, err := parseDeflateResponse(cli.Response.Header)
+	if err == nil && params != nil {
+		if cli.EnableCompression {
+			err = cli.CompressionParams.accept(params)
+		} else {
+			err = ErrBadExtension
+		}
+	}
+	if err != nil {
+		return err
+	}
+	cli.Conn = newConn(conn, br, false)
+	cli.Conn.subprotocol = subprotocol
+	cli.Conn.enableDeflate(params)
+	cli.Conn.setTimeouts(cli.ReadTimeout, cli.WriteTimeout, cli.IdleTimeout)
+	cli.Conn.SetFrameLimit(cli.MaxFrameSize)
+	cli.Conn.SetReadLimit(cli.MaxMessageSize)
+	cli.Conn.skipUTF8 = cli.SkipUTF8Validation
 	return nil
 }
 
+func (cli *Client) offered(subprotocol string) bool {
+	for _, p := range cli.Subprotocols {
+		if p == subprotocol {
+			return true
+		}
+	}
+	return false
+}
+
 func (cli *Client) WriteFrame(opcode byte, content []byte) error {
-	return nil //writeFrame(cli.Conn, opcode, content)
+	return cli.Conn.WriteMessage(opcode, content)
 }
 
 func (cli *Client) ReadFrame() (byte, []byte, error) {
-	return 0, nil, nil //readFrame(cli.Conn)
+	return cli.Conn.ReadMessage()
 }
 
 func (cli *Client) Close() error {
 	if cli.Conn == nil {
 		return nil
 	}
-	cli.WriteFrame(CloseMessage, []byte{0x03, 0xe8})
-	return cli.Conn.Close()
+	return cli.Conn.CloseWithCode(CloseNormalClosure, "")
 }
@@ -1,16 +1,25 @@
-package main
+package websocket
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
+	"time"
 )
 
 func TestClient(t *testing.T) {
-	ws, err := NewClient("ws://127.0.0.1:8080/ws")
+	addr := newTestServer(t, &Server{Handler: echoHandler})
+	ws, err := NewClient("ws://" + addr + "/ws")
 	if err != nil {
 		t.Fatal(err)
 	}
-	ws.Config = &tls.Config{InsecureSkipVerify: true}
 	err = ws.Connect()
 	if err != nil {
 		t.Fatal(err)
@@ -22,5 +31,245 @@ func TestClient(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	t.Log(opcode, string(content))
+	if opcode != TextMessage || string(content) != "hello world!" {
+		t.Fatalf("got %d %q", opcode, content)
+	}
+}
+
+// newSilentListener accepts connections and never answers them.
+func newSilentListener(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		var conns []net.Conn
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				break
+			}
+			conns = append(conns, conn)
+		}
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestConnectContextPhases(t *testing.T) {
+	addr := newSilentListener(t)
+	blockingResolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+	tests := []struct {
+		url      string
+		resolver *net.Resolver
+		phase    string
+	}{
+		{"ws://" + addr + "/ws", nil, PhaseHTTP},
+		{"wss://" + addr + "/ws", nil, PhaseTLS},
+		{"ws://example.invalid:80/ws", blockingResolver, PhaseDNS},
+	}
+	for _, tt := range tests {
+		cli, err := NewClient(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cli.HandshakeTimeout = 50 * time.Millisecond
+		cli.Dialer = &net.Dialer{Resolver: tt.resolver}
+		start := time.Now()
+		err = cli.Connect()
+		var cerr *ConnectError
+		if !errors.As(err, &cerr) || cerr.Phase != tt.phase || !cerr.Timeout() {
+			t.Errorf("%s: got %v", tt.url, err)
+		}
+		if d := time.Since(start); d > 2*time.Second {
+			t.Errorf("%s: took %v", tt.url, d)
+		}
+	}
+}
+
+func TestConnectContextCancel(t *testing.T) {
+	addr := newSilentListener(t)
+	cli, err := NewClient("ws://" + addr + "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	err = cli.ConnectContext(ctx)
+	var cerr *ConnectError
+	if !errors.As(err, &cerr) || cerr.Phase != PhaseHTTP || !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestClientHostPort(t *testing.T) {
+	tests := []struct {
+		url, host, port string
+		secure          bool
+	}{
+		{"ws://example.com/ws", "example.com", "80", false},
+		{"wss://example.com/ws", "example.com", "443", true},
+		{"http://example.com:8080", "example.com", "8080", false},
+		{"https://[::1]/", "::1", "443", true},
+	}
+	for _, tt := range tests {
+		cli, err := NewClient(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		host, port, secure, err := cli.hostPort()
+		if err != nil || host != tt.host || port != tt.port || secure != tt.secure {
+			t.Errorf("%s: got %s %s %v %v", tt.url, host, port, secure, err)
+		}
+	}
+	if _, err := NewClient("ftp://example.com/"); err != ErrBadScheme {
+		t.Errorf("got %v", err)
+	}
+	u, _ := url.Parse("ftp://example.com/")
+	cli := &Client{URL: u, Header: http.Header{}}
+	if err := cli.Connect(); err != ErrBadScheme {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestClientRequestURIAndSNI(t *testing.T) {
+	var upgrader Upgrader
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		info := r.URL.RequestURI()
+		if r.TLS != nil {
+			info += " " + r.TLS.ServerName
+		}
+		conn.WriteMessage(TextMessage, []byte(info))
+		conn.ReadMessage()
+	})
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+	tlsServer := httptest.NewTLSServer(handler)
+	defer tlsServer.Close()
+	_, tlsPort, _ := net.SplitHostPort(tlsServer.Listener.Addr().String())
+
+	tests := []struct {
+		url, want string
+	}{
+		{"ws://" + ts.Listener.Addr().String(), "/"},
+		{"ws://" + ts.Listener.Addr().String() + "?token=abc", "/?token=abc"},
+		{ts.URL + "/chat?room=1&user=2", "/chat?room=1&user=2"},
+		{"wss://localhost:" + tlsPort + "/secure", "/secure localhost"},
+	}
+	for _, tt := range tests {
+		cli, err := NewClient(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cli.Config = &tls.Config{InsecureSkipVerify: true}
+		if err := cli.Connect(); err != nil {
+			t.Fatalf("%s: %v", tt.url, err)
+		}
+		_, payload, err := cli.Conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(payload) != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.url, payload, tt.want)
+		}
+		cli.Close()
+	}
+}
+
+func TestClientKeepsPipelinedFrame(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go func() {
+		req, err := http.ReadRequest(bufio.NewReader(c2))
+		if err != nil {
+			return
+		}
+		accept, _ := genNonceAccept(req.Header.Get("Sec-WebSocket-Key"))
+		// The response and the first frame go out in a single write.
+		var buf bytes.Buffer
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + accept + "\r\n\r\n")
+		writeFrame(&buf, &Frame{FIN: true, OpCode: TextMessage, Length: 5, Payload: hello()})
+		c2.Write(buf.Bytes())
+	}()
+	cli, err := NewClient("ws://example.com/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.handshake(c1); err != nil {
+		t.Fatal(err)
+	}
+	c1.SetReadDeadline(time.Now().Add(5 * time.Second))
+	opcode, payload, err := cli.Conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opcode != TextMessage || string(payload) != "Hello" {
+		t.Fatalf("got %d %q", opcode, payload)
+	}
+}
+
+func TestClientResponseTokens(t *testing.T) {
+	for _, tt := range []struct {
+		header string
+		ok     bool
+	}{
+		{"Upgrade: websocket\r\nConnection: Upgrade\r\n", true},
+		{"Upgrade: WebSocket\r\nConnection: keep-alive, upgrade\r\n", true},
+		{"Upgrade: websocket\r\nConnection: keep-alive\r\n", false},
+		{"Upgrade: h2c\r\nConnection: Upgrade\r\n", false},
+	} {
+		c1, c2 := net.Pipe()
+		go func() {
+			req, err := http.ReadRequest(bufio.NewReader(c2))
+			if err != nil {
+				return
+			}
+			accept, _ := genNonceAccept(req.Header.Get("Sec-WebSocket-Key"))
+			c2.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" + tt.header + "Sec-WebSocket-Accept: " + accept + "\r\n\r\n"))
+		}()
+		cli, err := NewClient("ws://example.com/ws")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cli.handshake(c1); (err == nil) != tt.ok {
+			t.Errorf("%q: got %v", tt.header, err)
+		}
+		c1.Close()
+		c2.Close()
+	}
+}
+
+func TestClientOrigin(t *testing.T) {
+	tests := []struct {
+		url, origin string
+	}{
+		{"ws://example.com/ws", "http://example.com"},
+		{"wss://example.com:8443/ws", "https://example.com:8443"},
+		{"https://example.com/ws", "https://example.com"},
+	}
+	for _, tt := range tests {
+		cli, err := NewClient(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cli.Header.Get("Origin"); got != tt.origin {
+			t.Errorf("%s: got Origin %q, want %q", tt.url, got, tt.origin)
+		}
+	}
 }
@@ -0,0 +1,136 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultCloseTimeout = 5 * time.Second
+)
+
+// Close status codes defined in RFC 6455, section 7.4.1.
+const (
+	CloseNormalClosure           = 1000
+	CloseGoingAway               = 1001
+	CloseProtocolError           = 1002
+	CloseUnsupportedData         = 1003
+	CloseReserved                = 1004
+	CloseNoStatusReceived        = 1005
+	CloseAbnormalClosure         = 1006
+	CloseInvalidFramePayloadData = 1007
+	ClosePolicyViolation         = 1008
+	CloseMessageTooBig           = 1009
+	CloseMandatoryExtension      = 1010
+	CloseInternalServerErr       = 1011
+	CloseServiceRestart          = 1012
+	CloseTryAgainLater           = 1013
+	CloseBadGateway              = 1014
+	CloseTLSHandshake            = 1015
+)
+
+var (
+	ErrCloseSent          = errors.New("close frame already sent")
+	ErrInvalidCloseCode   = errors.New("invalid close code")
+	ErrInvalidCloseReason = errors.New("close reason must be valid UTF-8 of at most 123 bytes")
+)
+
+// CloseError is returned by reads once the peer has closed the connection.
+type CloseError struct {
+	Code int
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	if e.Text == "" {
+		return "close " + strconv.Itoa(e.Code)
+	}
+	return "close " + strconv.Itoa(e.Code) + ": " + e.Text
+}
+
+func formatCloseMessage(code int, text string) []byte {
+	p := make([]byte, 2+len(text))
+	binary.BigEndian.PutUint16(p, uint16(code))
+	copy(p[2:], text)
+	return p
+}
+
+func parseCloseMessage(p []byte) *CloseError {
+	if len(p) < 2 {
+		return &CloseError{Code: CloseNoStatusReceived}
+	}
+	return &CloseError{
+		Code: int(binary.BigEndian.Uint16(p)),
+		Text: string(p[2:]),
+	}
+}
+
+// isSendableCloseCode reports whether code may appear in a close frame.
+// 1005, 1006 and 1015 are reserved for reporting and never sent.
+func isSendableCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// awaitClose reads until the peer's close frame or deadline. A message
+// that another goroutine is reading is left to it, so that it is never
+// cut short with io.EOF; its reader gets the close frame once done with
+// the message. Called with readMu held.
+func (c *Conn) awaitClose(deadline time.Time) {
+	timer := time.AfterFunc(time.Until(deadline), func() {
+		c.readMu.Lock()
+		c.readCond.Broadcast()
+		c.readMu.Unlock()
+	})
+	defer timer.Stop()
+	var own reader
+	for c.readErr == nil {
+		if c.readerFull != nil && c.readerFull != own {
+			if !time.Now().Before(deadline) {
+				return
+			}
+			c.readCond.Wait()
+			continue
+		}
+		c.nextReader(&messageReader{c: c})
+		own = c.readerFull
+	}
+}
+
+// CloseWithCode sends a close frame with code and reason, waits up to the
+// close timeout for the peer to answer with its own close frame and then
+// closes the underlying connection. If another goroutine is reading, it
+// receives the peer's close frame as a *CloseError.
+func (c *Conn) CloseWithCode(code int, reason string) error {
+	if !isSendableCloseCode(code) {
+		return ErrInvalidCloseCode
+	}
+	if len(reason) > 123 || !utf8.ValidString(reason) {
+		return ErrInvalidCloseReason
+	}
+	err := c.writeFrame(CloseMessage, formatCloseMessage(code, reason), true, false)
+	if err == ErrCloseSent {
+		err = nil
+	} else if err == nil {
+		deadline := time.Now().Add(c.closeTimeout)
+		c.SetReadDeadline(deadline)
+		c.readMu.Lock()
+		// The message timeouts would move the deadline set above.
+		c.readTimeout, c.idleTimeout = 0, 0
+		c.SetReadDeadline(deadline)
+		c.awaitClose(deadline)
+		c.readMu.Unlock()
+	}
+	if cerr := c.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,120 @@
+package websocket
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCloseWithCode(t *testing.T) {
+	client, server := newTestConnPair()
+	defer server.Close()
+	errs := make(chan error, 1)
+	go func() {
+		_, _, err := server.ReadMessage()
+		errs <- err
+	}()
+	if err := client.CloseWithCode(CloseNormalClosure, "bye"); err != nil {
+		t.Fatal(err)
+	}
+	var cerr *CloseError
+	if err := <-errs; !errors.As(err, &cerr) || cerr.Code != CloseNormalClosure || cerr.Text != "bye" {
+		t.Fatalf("got %v", err)
+	}
+	if _, _, err := client.ReadMessage(); !errors.As(err, &cerr) || cerr.Code != CloseNormalClosure {
+		t.Fatalf("expected echoed close, got %v", err)
+	}
+}
+
+func TestCloseWithCodeConcurrentReader(t *testing.T) {
+	client, server := newTestConnPair()
+	defer server.Close()
+	go echoHandler(server, nil)
+	errs := make(chan error, 1)
+	go func() {
+		_, _, err := client.ReadMessage()
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := client.CloseWithCode(CloseGoingAway, ""); err != nil {
+		t.Fatal(err)
+	}
+	var cerr *CloseError
+	if err := <-errs; !errors.As(err, &cerr) || cerr.Code != CloseGoingAway {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestCloseWithCodeLeavesMessageToReader(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		client, server := newTestConnPair()
+		if compress {
+			client.enableDeflate(&deflateParams{})
+			server.enableDeflate(&deflateParams{})
+		}
+		go func() {
+			server.WriteMessage(TextMessage, []byte("Hello"))
+			server.ReadMessage()
+		}()
+		_, r, err := client.NextReader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		closed := make(chan error, 1)
+		go func() { closed <- client.CloseWithCode(CloseNormalClosure, "") }()
+		time.Sleep(10 * time.Millisecond)
+		p, err := io.ReadAll(r)
+		if err != nil || string(p) != "Hello" {
+			t.Fatalf("compress=%v: got %q, %v", compress, p, err)
+		}
+		var cerr *CloseError
+		if _, _, err := client.NextReader(); !errors.As(err, &cerr) || cerr.Code != CloseNormalClosure {
+			t.Fatalf("compress=%v: got %v", compress, err)
+		}
+		if err := <-closed; err != nil {
+			t.Fatal(err)
+		}
+		server.Close()
+	}
+}
+
+func TestCloseWithCodeTimeout(t *testing.T) {
+	client, server := newTestConnPair()
+	defer server.Close()
+	go discardFrames(server)
+	client.closeTimeout = 20 * time.Millisecond
+	start := time.Now()
+	client.CloseWithCode(CloseNormalClosure, "")
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("close took %v", d)
+	}
+}
+
+func TestCloseWithCodeInvalid(t *testing.T) {
+	client, server := newTestConnPair()
+	defer client.Close()
+	defer server.Close()
+	if err := client.CloseWithCode(CloseNoStatusReceived, ""); err != ErrInvalidCloseCode {
+		t.Fatalf("got %v", err)
+	}
+	if err := client.CloseWithCode(CloseNormalClosure, strings.Repeat("x", 124)); err != ErrInvalidCloseReason {
+		t.Fatalf("got %v", err)
+	}
+	if err := client.CloseWithCode(CloseNormalClosure, "\xff"); err != ErrInvalidCloseReason {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestCloseNoStatus(t *testing.T) {
+	client, server := newTestConnPair()
+	defer client.Close()
+	defer server.Close()
+	go discardFrames(server)
+	writeTestFrames(server.Conn, &Frame{FIN: true, OpCode: CloseMessage})
+	var cerr *CloseError
+	if _, _, err := client.ReadMessage(); !errors.As(err, &cerr) || cerr.Code != CloseNoStatusReceived {
+		t.Fatalf("got %v", err)
+	}
+}
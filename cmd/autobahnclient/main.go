@@ -0,0 +1,95 @@
+// Command autobahnclient runs the Autobahn TestSuite fuzzingserver cases
+// against this package's client, echoing every message back, and then
+// asks the server to write its reports.
+//
+//	wstest -m fuzzingserver
+//	go run ./cmd/autobahnclient -server ws://127.0.0.1:9001
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"net/url"
+	"strconv"
+
+	"github.com/Yiwen-Chan/websocket"
+)
+
+var (
+	server   = flag.String("server", "ws://127.0.0.1:9001", "fuzzingserver URL")
+	agent    = flag.String("agent", "kanrichan/websocket", "agent name in the reports")
+	compress = flag.Bool("compress", true, "offer permessage-deflate")
+)
+
+func connect(path string, query url.Values) (*websocket.Client, error) {
+	cli, err := websocket.NewClient(*server + path + "?" + query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	cli.EnableCompression = *compress
+	return cli, cli.Connect()
+}
+
+func caseCount() (int, error) {
+	cli, err := connect("/getCaseCount", nil)
+	if err != nil {
+		return 0, err
+	}
+	defer cli.Close()
+	_, p, err := cli.Conn.ReadMessage()
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(p))
+}
+
+func runCase(n int) error {
+	cli, err := connect("/runCase", url.Values{"case": {strconv.Itoa(n)}, "agent": {*agent}})
+	if err != nil {
+		return err
+	}
+	defer cli.Conn.Close()
+	for {
+		opcode, r, err := cli.Conn.NextReader()
+		if err != nil {
+			return nil
+		}
+		w, err := cli.Conn.NextWriter(opcode)
+		if err != nil {
+			return nil
+		}
+		_, err = io.Copy(w, r)
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+func updateReports() error {
+	cli, err := connect("/updateReports", url.Values{"agent": {*agent}})
+	if err != nil {
+		return err
+	}
+	return cli.Close()
+}
+
+func main() {
+	flag.Parse()
+	count, err := caseCount()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for n := 1; n <= count; n++ {
+		log.Printf("running case %d of %d", n, count)
+		if err := runCase(n); err != nil {
+			log.Printf("case %d: %v", n, err)
+		}
+	}
+	if err := updateReports(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,55 @@
+// Command echoserver is a websocket echo server for the Autobahn
+// TestSuite fuzzingclient. It echoes every message back with the same
+// opcode, streaming it so that large and fragmented messages pass through
+// unchanged.
+//
+//	go run ./cmd/echoserver -addr 127.0.0.1:9001
+//
+// and point the fuzzingclient spec at ws://127.0.0.1:9001.
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/Yiwen-Chan/websocket"
+)
+
+func echo(conn *websocket.Conn, req *http.Request) {
+	for {
+		opcode, r, err := conn.NextReader()
+		if err != nil {
+			return
+		}
+		w, err := conn.NextWriter(opcode)
+		if err != nil {
+			return
+		}
+		_, err = io.Copy(w, r)
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:9001", "address to listen on")
+	compress := flag.Bool("compress", true, "accept permessage-deflate")
+	flag.Parse()
+
+	srv, err := websocket.NewServer(*addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv.EnableCompression = *compress
+	srv.Handler = echo
+	// The fuzzingclient is not a browser; accept whatever it sends.
+	srv.CheckOrigin = func(*http.Request) bool { return true }
+	log.Printf("echo server listening on %s", *addr)
+	log.Fatal(srv.Listen())
+}
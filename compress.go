@@ -0,0 +1,357 @@
+package websocket
+
+import (
+	"compress/flate"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultCompressionLevel = flate.BestSpeed
+
+	// maxWindowSize is the largest LZ77 window of permessage-deflate, used
+	// as the dictionary size when the peer keeps its compression context.
+	maxWindowSize = 1 << 15
+
+	// deflateTail completes a message compressed with a sync flush. The
+	// first four bytes are the ones stripped by the sender (RFC 7692,
+	// section 7.2.2); the rest is an empty final block so that the flate
+	// reader reports io.EOF.
+	deflateTail = "\x00\x00\xff\xff\x01\x00\x00\xff\xff"
+)
+
+var (
+	ErrBadExtension  = errors.New("bad Sec-WebSocket-Extensions in response")
+	ErrBadWindowBits = errors.New("max window bits must be between 8 and 15")
+)
+
+// CompressionParams are the permessage-deflate parameters (RFC 7692,
+// section 7.1) a client offers. The zero value offers the extension with
+// no parameters.
+type CompressionParams struct {
+	// ServerNoContextTakeover asks the server to compress every message
+	// on its own, so that the client need not keep its window between
+	// messages. ClientNoContextTakeover does the same for the client.
+	ServerNoContextTakeover bool
+	ClientNoContextTakeover bool
+
+	// ServerMaxWindowBits, if nonzero, limits the server's LZ77 window to
+	// 2^ServerMaxWindowBits bytes. It must be between 8 and 15.
+	ServerMaxWindowBits int
+
+	// ClientMaxWindowBits tells the server it may limit the client's
+	// window. compress/flate always uses a 32 KiB window, so a server
+	// that asks for less than 15 bits is refused.
+	ClientMaxWindowBits bool
+}
+
+// offer returns the Sec-WebSocket-Extensions value offering p.
+func (p *CompressionParams) offer() (string, error) {
+	ext := "permessage-deflate"
+	if p.ServerNoContextTakeover {
+		ext += "; server_no_context_takeover"
+	}
+	if p.ClientNoContextTakeover {
+		ext += "; client_no_context_takeover"
+	}
+	if p.ServerMaxWindowBits != 0 {
+		if p.ServerMaxWindowBits < 8 || p.ServerMaxWindowBits > 15 {
+			return "", ErrBadWindowBits
+		}
+		ext += "; server_max_window_bits=" + strconv.Itoa(p.ServerMaxWindowBits)
+	}
+	if p.ClientMaxWindowBits {
+		ext += "; client_max_window_bits"
+	}
+	return ext, nil
+}
+
+// accept checks the parameters of the server's response against the
+// offer, and applies client_no_context_takeover if it was offered.
+func (p *CompressionParams) accept(params *deflateParams) error {
+	if p.ServerNoContextTakeover && !params.serverNoContextTakeover {
+		return ErrBadExtension
+	}
+	if p.ServerMaxWindowBits != 0 &&
+		(params.serverMaxWindowBits == 0 || params.serverMaxWindowBits > p.ServerMaxWindowBits) {
+		return ErrBadExtension
+	}
+	if params.clientMaxWindowBits != 0 && !p.ClientMaxWindowBits {
+		return ErrBadExtension
+	}
+	if p.ClientNoContextTakeover {
+		params.clientNoContextTakeover = true
+	}
+	return nil
+}
+
+// extension is one element of a Sec-WebSocket-Extensions header.
+type extension struct {
+	name   string
+	params map[string]string
+}
+
+// parseExtensions parses every Sec-WebSocket-Extensions header line. An
+// offer with a repeated parameter is returned with params set to nil.
+func parseExtensions(header http.Header) []extension {
+	var exts []extension
+	for _, line := range header.Values("Sec-WebSocket-Extensions") {
+		for _, item := range strings.Split(line, ",") {
+			parts := strings.Split(item, ";")
+			name := strings.TrimSpace(parts[0])
+			if name == "" {
+				continue
+			}
+			ext := extension{name: strings.ToLower(name), params: map[string]string{}}
+			for _, param := range parts[1:] {
+				k, v := param, ""
+				if i := strings.IndexByte(param, '='); i >= 0 {
+					k, v = param[:i], strings.Trim(strings.TrimSpace(param[i+1:]), `"`)
+				}
+				k = strings.ToLower(strings.TrimSpace(k))
+				if _, ok := ext.params[k]; ok {
+					ext.params = nil
+					break
+				}
+				ext.params[k] = v
+			}
+			exts = append(exts, ext)
+		}
+	}
+	return exts
+}
+
+func validWindowBits(v string) bool {
+	switch v {
+	case "8", "9", "10", "11", "12", "13", "14", "15":
+		return true
+	}
+	return false
+}
+
+// negotiateDeflate picks the first permessage-deflate offer in the
+// request that can be honoured and returns the extension to answer with.
+// Offers limiting server_max_window_bits below 15 are declined because
+// compress/flate always compresses with a 32 KiB window.
+func negotiateDeflate(header http.Header) (string, bool) {
+offers:
+	for _, ext := range parseExtensions(header) {
+		if ext.name != "permessage-deflate" || ext.params == nil {
+			continue
+		}
+		for k, v := range ext.params {
+			switch k {
+			case "server_no_context_takeover", "client_no_context_takeover":
+				if v != "" {
+					continue offers
+				}
+			case "server_max_window_bits":
+				if v != "15" {
+					continue offers
+				}
+			case "client_max_window_bits":
+				if v != "" && !validWindowBits(v) {
+					continue offers
+				}
+			default:
+				continue offers
+			}
+		}
+		response := "permessage-deflate"
+		for _, k := range []string{"server_no_context_takeover", "client_no_context_takeover"} {
+			if _, ok := ext.params[k]; ok {
+				response += "; " + k
+			}
+		}
+		// An accepted server_max_window_bits must be echoed (RFC 7692,
+		// section 7.1.2.1).
+		if _, ok := ext.params["server_max_window_bits"]; ok {
+			response += "; server_max_window_bits=15"
+		}
+		return response, true
+	}
+	return "", false
+}
+
+// deflateParams are the negotiated permessage-deflate parameters.
+type deflateParams struct {
+	serverNoContextTakeover bool
+	clientNoContextTakeover bool
+	serverMaxWindowBits     int // 0 if absent
+	clientMaxWindowBits     int // 0 if absent
+}
+
+// parseDeflateResponse reads the permessage-deflate parameters from the
+// extensions of a handshake response. It returns nil if the extension was
+// not negotiated, and ErrBadExtension for a malformed response or one that
+// limits the client's window below 15 bits. CompressionParams.accept
+// checks the result against the client's offer.
+func parseDeflateResponse(header http.Header) (*deflateParams, error) {
+	exts := parseExtensions(header)
+	if len(exts) == 0 {
+		return nil, nil
+	}
+	if len(exts) > 1 || exts[0].name != "permessage-deflate" || exts[0].params == nil {
+		return nil, ErrBadExtension
+	}
+	params := &deflateParams{}
+	for k, v := range exts[0].params {
+		switch k {
+		case "server_no_context_takeover":
+			params.serverNoContextTakeover = true
+		case "client_no_context_takeover":
+			params.clientNoContextTakeover = true
+		case "server_max_window_bits":
+			if !validWindowBits(v) {
+				return nil, ErrBadExtension
+			}
+			params.serverMaxWindowBits, _ = strconv.Atoi(v)
+		case "client_max_window_bits":
+			if v != "15" {
+				return nil, ErrBadExtension
+			}
+			params.clientMaxWindowBits = 15
+		default:
+			return nil, ErrBadExtension
+		}
+	}
+	return params, nil
+}
+
+func (c *Conn) enableDeflate(params *deflateParams) {
+	if params == nil {
+		return
+	}
+	c.compress = true
+	if c.isServer {
+		c.readNoContextTakeover = params.clientNoContextTakeover
+		c.writeNoContextTakeover = params.serverNoContextTakeover
+	} else {
+		c.readNoContextTakeover = params.serverNoContextTakeover
+		c.writeNoContextTakeover = params.clientNoContextTakeover
+	}
+}
+
+// truncWriter holds back the last four bytes written to it, which after a
+// sync flush are always the 0x00 0x00 0xff 0xff trailer.
+type truncWriter struct {
+	w *messageWriter
+	p [4]byte
+	n int
+}
+
+func (t *truncWriter) Write(p []byte) (int, error) {
+	total := len(p)
+	if t.n+len(p) <= len(t.p) {
+		t.n += copy(t.p[t.n:], p)
+		return total, nil
+	}
+	// Send the held bytes that are no longer among the last four.
+	m := t.n + len(p) - len(t.p)
+	if m > t.n {
+		m = t.n
+	}
+	if _, err := t.w.writeRaw(t.p[:m]); err != nil {
+		return 0, err
+	}
+	t.n = copy(t.p[:], t.p[m:t.n])
+	if len(p) > len(t.p) {
+		if _, err := t.w.writeRaw(p[:len(p)-len(t.p)]); err != nil {
+			return 0, err
+		}
+		p = p[len(p)-len(t.p):]
+	}
+	t.n += copy(t.p[t.n:], p)
+	return total, nil
+}
+
+func (c *Conn) beginCompress(w *messageWriter) {
+	w.compress = true
+	w.rsv1 = true
+	c.flateDst = truncWriter{w: w}
+	if c.flateWriter == nil {
+		c.flateWriter, _ = flate.NewWriter(&c.flateDst, defaultCompressionLevel)
+	}
+}
+
+func (c *Conn) endCompress() error {
+	if err := c.flateWriter.Flush(); err != nil {
+		return err
+	}
+	if c.writeNoContextTakeover {
+		c.flateWriter.Reset(&c.flateDst)
+	}
+	return nil
+}
+
+// readerFunc adapts an unlocked read method to io.Reader.
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
+type flateReader struct {
+	c *Conn
+}
+
+func (c *Conn) newFlateReader(raw *messageReader) *flateReader {
+	src := io.MultiReader(readerFunc(raw.read), strings.NewReader(deflateTail))
+	var dict []byte
+	if !c.readNoContextTakeover {
+		dict = c.readDict
+	}
+	if c.flateReader == nil {
+		c.flateReader = flate.NewReaderDict(src, dict)
+	} else {
+		c.flateReader.(flate.Resetter).Reset(src, dict)
+	}
+	return &flateReader{c: c}
+}
+
+func (r *flateReader) Read(p []byte) (int, error) {
+	r.c.readMu.Lock()
+	defer r.c.readMu.Unlock()
+	n, err := r.read(p)
+	r.c.readCond.Broadcast()
+	return n, err
+}
+
+func (r *flateReader) read(p []byte) (int, error) {
+	c := r.c
+	if c.readerFull != r {
+		return 0, io.EOF
+	}
+	n, err := c.flateReader.Read(p)
+	c.readInflated += int64(n)
+	if c.readLimit > 0 && c.readInflated > c.readLimit {
+		c.readErr = c.failRead(CloseMessageTooBig, ErrReadLimit)
+		return 0, c.readErr
+	}
+	if uerr := c.checkUTF8(p[:n], err == io.EOF); uerr != nil {
+		c.readErr = uerr
+		return 0, uerr
+	}
+	if err == io.EOF {
+		c.readerFull = nil
+		// A block with BFINAL set may be followed by more bytes (RFC
+		// 7692, section 7.2.3.3); skip them to reach the end of the
+		// message.
+		if derr := c.drainReader(); derr != nil {
+			err = derr
+		}
+	}
+	if !c.readNoContextTakeover {
+		c.readDict = append(c.readDict, p[:n]...)
+		if len(c.readDict) > maxWindowSize {
+			c.readDict = append(c.readDict[:0], c.readDict[len(c.readDict)-maxWindowSize:]...)
+		}
+	}
+	if err == io.ErrUnexpectedEOF && c.readErr != nil {
+		err = c.readErr
+	}
+	return n, err
+}
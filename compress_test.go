@@ -0,0 +1,325 @@
+package websocket
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateDeflate(t *testing.T) {
+	tests := []struct {
+		offer    string
+		response string
+		ok       bool
+	}{
+		{"permessage-deflate", "permessage-deflate", true},
+		{"permessage-deflate; client_max_window_bits", "permessage-deflate", true},
+		{"permessage-deflate; server_no_context_takeover; client_no_context_takeover", "permessage-deflate; server_no_context_takeover; client_no_context_takeover", true},
+		{"permessage-deflate; server_max_window_bits=10, permessage-deflate", "permessage-deflate", true},
+		{"permessage-deflate; server_max_window_bits=10", "", false},
+		{"permessage-deflate; server_max_window_bits=15", "permessage-deflate; server_max_window_bits=15", true},
+		{"permessage-deflate; client_max_window_bits=16", "", false},
+		{"permessage-deflate; server_no_context_takeover; server_no_context_takeover", "", false},
+		{"permessage-deflate; unknown", "", false},
+		{"x-webkit-deflate-frame", "", false},
+	}
+	for _, tt := range tests {
+		header := http.Header{"Sec-Websocket-Extensions": {tt.offer}}
+		response, ok := negotiateDeflate(header)
+		if response != tt.response || ok != tt.ok {
+			t.Errorf("%q: got %q %v, want %q %v", tt.offer, response, ok, tt.response, tt.ok)
+		}
+	}
+}
+
+func TestParseDeflateResponse(t *testing.T) {
+	tests := []struct {
+		response string
+		params   *deflateParams
+		err      error
+	}{
+		{"permessage-deflate", &deflateParams{}, nil},
+		{"permessage-deflate; server_no_context_takeover; server_max_window_bits=10", &deflateParams{serverNoContextTakeover: true, serverMaxWindowBits: 10}, nil},
+		{"permessage-deflate; client_no_context_takeover", &deflateParams{clientNoContextTakeover: true}, nil},
+		{"permessage-deflate; client_max_window_bits=15", &deflateParams{clientMaxWindowBits: 15}, nil},
+		{"permessage-deflate; client_max_window_bits=10", nil, ErrBadExtension},
+		{"permessage-deflate; foo", nil, ErrBadExtension},
+		{"foo", nil, ErrBadExtension},
+	}
+	for _, tt := range tests {
+		params, err := parseDeflateResponse(http.Header{"Sec-Websocket-Extensions": {tt.response}})
+		if err != tt.err || (params == nil) != (tt.params == nil) || (params != nil && *params != *tt.params) {
+			t.Errorf("%q: got %+v %v", tt.response, params, err)
+		}
+	}
+}
+
+func TestCompressionParams(t *testing.T) {
+	tests := []struct {
+		params   CompressionParams
+		offer    string
+		response string
+		err      error
+	}{
+		{CompressionParams{}, "permessage-deflate", "permessage-deflate; server_no_context_takeover", nil},
+		{CompressionParams{}, "permessage-deflate", "permessage-deflate; client_max_window_bits=15", ErrBadExtension},
+		{
+			CompressionParams{ServerNoContextTakeover: true, ClientNoContextTakeover: true},
+			"permessage-deflate; server_no_context_takeover; client_no_context_takeover",
+			"permessage-deflate; server_no_context_takeover", nil,
+		},
+		{CompressionParams{ServerNoContextTakeover: true}, "permessage-deflate; server_no_context_takeover", "permessage-deflate", ErrBadExtension},
+		{CompressionParams{ServerMaxWindowBits: 10}, "permessage-deflate; server_max_window_bits=10", "permessage-deflate; server_max_window_bits=9", nil},
+		{CompressionParams{ServerMaxWindowBits: 10}, "permessage-deflate; server_max_window_bits=10", "permessage-deflate; server_max_window_bits=11", ErrBadExtension},
+		{CompressionParams{ServerMaxWindowBits: 10}, "permessage-deflate; server_max_window_bits=10", "permessage-deflate", ErrBadExtension},
+		{CompressionParams{ClientMaxWindowBits: true}, "permessage-deflate; client_max_window_bits", "permessage-deflate; client_max_window_bits=15", nil},
+	}
+	for _, tt := range tests {
+		offer, err := tt.params.offer()
+		if err != nil || offer != tt.offer {
+			t.Errorf("%+v: offered %q, %v", tt.params, offer, err)
+			continue
+		}
+		params, err := parseDeflateResponse(http.Header{"Sec-Websocket-Extensions": {tt.response}})
+		if err == nil {
+			err = tt.params.accept(params)
+		}
+		if err != tt.err {
+			t.Errorf("%q for %q: got %v, want %v", tt.response, offer, err, tt.err)
+		}
+		if err == nil && params.clientNoContextTakeover != tt.params.ClientNoContextTakeover {
+			t.Errorf("%q: client_no_context_takeover not applied", offer)
+		}
+	}
+	for _, bits := range []int{7, 16} {
+		if _, err := (&CompressionParams{ServerMaxWindowBits: bits}).offer(); err != ErrBadWindowBits {
+			t.Errorf("server_max_window_bits=%d: got %v", bits, err)
+		}
+	}
+}
+
+func TestDeflateRFC7692Example(t *testing.T) {
+	client, server := newTestConnPair()
+	defer client.Close()
+	defer server.Close()
+	client.enableDeflate(&deflateParams{})
+	// RFC 7692, section 7.2.3.2: "Hello" twice with context takeover.
+	go server.Conn.Write([]byte{
+		0xc1, 0x07, 0xf2, 0x48, 0xcd, 0xc9, 0xc9, 0x07, 0x00,
+		0xc1, 0x05, 0xf2, 0x00, 0x11, 0x00, 0x00,
+	})
+	for i := 0; i < 2; i++ {
+		opcode, payload, err := client.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opcode != TextMessage || string(payload) != "Hello" {
+			t.Fatalf("got %d %q", opcode, payload)
+		}
+	}
+}
+
+func TestDeflateRFC7692FinalBlock(t *testing.T) {
+	client, server := newTestConnPair()
+	defer client.Close()
+	defer server.Close()
+	client.enableDeflate(&deflateParams{})
+	// RFC 7692, section 7.2.3.3: a block with BFINAL set, followed by a
+	// trailing byte, then a plain text frame.
+	go server.Conn.Write([]byte{
+		0xc1, 0x08, 0xf3, 0x48, 0xcd, 0xc9, 0xc9, 0x07, 0x00, 0x00,
+		0x81, 0x05, 'W', 'o', 'r', 'l', 'd',
+	})
+	for _, want := range []string{"Hello", "World"} {
+		opcode, payload, err := client.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opcode != TextMessage || string(payload) != want {
+			t.Fatalf("got %d %q, want %q", opcode, payload, want)
+		}
+	}
+}
+
+func TestDeflateRoundTrip(t *testing.T) {
+	for _, params := range []deflateParams{
+		{},
+		{serverNoContextTakeover: true},
+		{clientNoContextTakeover: true},
+		{serverNoContextTakeover: true, clientNoContextTakeover: true},
+	} {
+		client, server := newTestConnPair()
+		client.enableDeflate(&params)
+		server.enableDeflate(&params)
+		messages := [][]byte{
+			[]byte(`{"type":"chat","room":"general","text":"hello"}`),
+			[]byte(`{"type":"chat","room":"general","text":"hello again"}`),
+			{},
+			[]byte(strings.Repeat(`{"type":"chat","room":"general"}`, 1000)),
+		}
+		go func() {
+			for _, m := range messages {
+				if err := client.WriteMessage(TextMessage, m); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+		for _, m := range messages {
+			frame, err := readFrameHeader(server.br)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !frame.RSV[0] {
+				t.Fatalf("%+v: RSV1 not set", params)
+			}
+			server.beginFrame(frame)
+			server.reader = &messageReader{c: server}
+			fr := server.newFlateReader(server.reader)
+			server.readerFull = fr
+			var got bytes.Buffer
+			if _, err := got.ReadFrom(fr); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Bytes(), m) {
+				t.Fatalf("%+v: got %q, want %q", params, got.Bytes(), m)
+			}
+			if len(m) > 1000 && frame.Length >= len(m)/10 {
+				t.Fatalf("%+v: %d bytes compressed to %d", params, len(m), frame.Length)
+			}
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestDeflateReadLimit(t *testing.T) {
+	client, server := newTestConnPair()
+	defer client.Close()
+	defer server.Close()
+	client.enableDeflate(&deflateParams{})
+	server.enableDeflate(&deflateParams{})
+	server.SetReadLimit(1 << 16)
+	// Compresses to far less than the limit but inflates past it.
+	go client.WriteMessage(BinaryMessage, make([]byte, 1<<20))
+	code := readCloseCode(client)
+	if _, _, err := server.ReadMessage(); err != ErrReadLimit {
+		t.Fatalf("got %v, want %v", err, ErrReadLimit)
+	}
+	if c := <-code; c != CloseMessageTooBig {
+		t.Fatalf("got close code %d, want %d", c, CloseMessageTooBig)
+	}
+}
+
+func TestDeflateInvalidUTF8(t *testing.T) {
+	client, server := newTestConnPair()
+	defer client.Close()
+	defer server.Close()
+	client.enableDeflate(&deflateParams{})
+	server.enableDeflate(&deflateParams{})
+	// Only the inflated payload can be checked.
+	go client.WriteMessage(TextMessage, []byte("compressed \xff"))
+	code := readCloseCode(client)
+	if _, _, err := server.ReadMessage(); err != ErrInvalidUTF8 {
+		t.Fatalf("got %v, want %v", err, ErrInvalidUTF8)
+	}
+	if c := <-code; c != CloseInvalidFramePayloadData {
+		t.Fatalf("got close code %d, want %d", c, CloseInvalidFramePayloadData)
+	}
+}
+
+func TestDeflateHandshake(t *testing.T) {
+	server := &Server{Handler: echoHandler}
+	server.EnableCompression = true
+	addr := newTestServer(t, server)
+	cli, err := NewClient("ws://" + addr + "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.EnableCompression = true
+	if err := cli.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if !cli.Conn.compress {
+		t.Fatal("compression not negotiated")
+	}
+	payload := []byte(strings.Repeat("compress me ", 500))
+	for i := 0; i < 3; i++ {
+		if err := cli.Conn.WriteMessage(BinaryMessage, payload); err != nil {
+			t.Fatal(err)
+		}
+		_, got, err := cli.Conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Fatalf("got %d bytes", len(got))
+		}
+	}
+}
+
+func TestDeflateHandshakeParams(t *testing.T) {
+	server := &Server{Handler: echoHandler}
+	server.EnableCompression = true
+	addr := newTestServer(t, server)
+
+	cli, err := NewClient("ws://" + addr + "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.EnableCompression = true
+	cli.CompressionParams = CompressionParams{ServerNoContextTakeover: true, ClientNoContextTakeover: true}
+	if err := cli.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if !cli.Conn.compress || !cli.Conn.readNoContextTakeover || !cli.Conn.writeNoContextTakeover {
+		t.Fatalf("got %q", cli.Response.Header.Get("Sec-WebSocket-Extensions"))
+	}
+	for i := 0; i < 2; i++ {
+		if err := cli.Conn.WriteMessage(TextMessage, hello()); err != nil {
+			t.Fatal(err)
+		}
+		if _, got, err := cli.Conn.ReadMessage(); err != nil || string(got) != "Hello" {
+			t.Fatalf("got %q, %v", got, err)
+		}
+	}
+
+	// The server only compresses with a full window, which it must echo.
+	cli, err = NewClient("ws://" + addr + "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.EnableCompression = true
+	cli.CompressionParams.ServerMaxWindowBits = 15
+	if err := cli.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if !cli.Conn.compress {
+		t.Fatalf("got %q", cli.Response.Header.Get("Sec-WebSocket-Extensions"))
+	}
+	if err := cli.Conn.WriteMessage(TextMessage, hello()); err != nil {
+		t.Fatal(err)
+	}
+	if _, got, err := cli.Conn.ReadMessage(); err != nil || string(got) != "Hello" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+
+	// Anything smaller is declined.
+	cli, err = NewClient("ws://" + addr + "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.EnableCompression = true
+	cli.CompressionParams.ServerMaxWindowBits = 10
+	if err := cli.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if cli.Conn.compress {
+		t.Fatal("compression negotiated despite server_max_window_bits=10")
+	}
+}
@@ -0,0 +1,778 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultWriteBufferSize = 4096
+
+	// maxPooledBufferSize is the largest message buffer kept for reuse.
+	maxPooledBufferSize = 1 << 20
+)
+
+var (
+	// writeBufferPool holds message writer buffers of the default size.
+	writeBufferPool = sync.Pool{New: func() interface{} {
+		p := make([]byte, 0, defaultWriteBufferSize)
+		return &p
+	}}
+	// readBufferPool holds buffers for reassembling fragmented or
+	// compressed messages in ReadMessage.
+	readBufferPool = sync.Pool{New: func() interface{} {
+		return new(bytes.Buffer)
+	}}
+)
+
+var (
+	ErrUnknownOpCode          = errors.New("unknown opcode")
+	ErrFragmentedControl      = errors.New("fragmented control frame")
+	ErrControlTooLong         = errors.New("control frame payload exceeds 125 bytes")
+	ErrUnexpectedContinuation = errors.New("continuation frame without a message in progress")
+	ErrInterleavedData        = errors.New("data frame while a fragmented message is in progress")
+	ErrWriterClosed           = errors.New("message writer closed")
+	ErrReadLimit              = errors.New("message exceeds read limit")
+	ErrReservedBits           = errors.New("reserved bits set without a negotiated extension")
+	ErrUnmaskedFrame          = errors.New("unmasked frame from client")
+	ErrMaskedFrame            = errors.New("masked frame from server")
+	ErrBadClosePayload        = errors.New("close frame with a 1-byte payload or an invalid code")
+
+	ErrReadTimeout  error = timeoutError("read timeout")
+	ErrWriteTimeout error = timeoutError("write timeout")
+	ErrIdleTimeout  error = timeoutError("idle timeout")
+)
+
+// timeoutError implements net.Error so that callers checking Timeout()
+// treat the message-level timeouts like deadline errors.
+type timeoutError string
+
+func (e timeoutError) Error() string   { return string(e) }
+func (e timeoutError) Timeout() bool   { return true }
+func (e timeoutError) Temporary() bool { return false }
+
+func isTimeout(err error) bool {
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Timeout()
+}
+
+// Conn is a websocket connection on top of an upgraded net.Conn.
+//
+// Writes are safe for concurrent use. A data message is written as a
+// whole: NextWriter holds the connection's data writer until the returned
+// writer is closed, so fragments of different messages never interleave,
+// while control frames can still be sent between them. Reads are not:
+// at most one goroutine may call NextReader, ReadMessage or Read on a
+// message reader at a time.
+type Conn struct {
+	net.Conn
+
+	// br holds any bytes buffered while reading the handshake.
+	br          *bufio.Reader
+	isServer    bool
+	subprotocol string
+
+	// state of the message being read
+	readMu        sync.Mutex
+	readCond      *sync.Cond // broadcast after every read, see CloseWithCode
+	reader        *messageReader
+	readerFull    reader
+	readErr       error
+	readFinal     bool
+	readRemaining int
+	readMask      bool
+	readMaskKey   [4]byte
+	readMaskPos   int
+
+	// Reused by every frame and by ReadMessage so that reading does not
+	// allocate.
+	frame       Frame
+	readScratch [8]byte
+	controlBuf  [125]byte
+	ownReader   messageReader
+
+	// readText is set while a text message is read and validated,
+	// unless skipUTF8 is set.
+	readText bool
+	readUTF8 utf8Validator
+	skipUTF8 bool
+
+	// readLength counts the payload of the message being read against
+	// readLimit, on the wire and, when compressed, inflated.
+	readLimit    int64
+	frameLimit   int64
+	readLength   int64
+	readInflated int64
+
+	// dataMu is held by the data message being written; writeMu by
+	// every single frame and the fields after it.
+	dataMu          sync.Mutex
+	writeBufferSize int
+	writeMu         sync.Mutex
+	closeSent       bool
+	bw              *bufio.Writer
+	writeHeader     [maxHeaderSize]byte
+	maskKeys        [64]byte
+	maskPos         int
+
+	// permessage-deflate state, see compress.go
+	compress               bool
+	readNoContextTakeover  bool
+	writeNoContextTakeover bool
+	flateReader            io.ReadCloser
+	readDict               []byte
+	flateWriter            *flate.Writer
+	flateDst               truncWriter
+
+	// see setTimeouts
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	idleTimeout  time.Duration
+
+	closeTimeout time.Duration
+	pong         chan struct{}
+	done         chan struct{}
+	closeOnce    sync.Once
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, isServer bool) *Conn {
+	if br == nil {
+		br = bufio.NewReader(conn)
+	}
+	c := &Conn{
+		Conn:            conn,
+		br:              br,
+		isServer:        isServer,
+		writeBufferSize: defaultWriteBufferSize,
+		bw:              bufio.NewWriterSize(conn, defaultWriteBufferSize+maxHeaderSize),
+		closeTimeout:    defaultCloseTimeout,
+		pong:            make(chan struct{}, 1),
+		done:            make(chan struct{}),
+	}
+	c.ownReader.c = c
+	c.readCond = sync.NewCond(&c.readMu)
+	return c
+}
+
+// Subprotocol returns the subprotocol negotiated during the handshake,
+// or "" if none was.
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// Close closes the underlying connection and stops the keepalive loop.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
+
+// SetReadLimit sets the maximum size in bytes of a message read from the
+// peer, counting all of its fragments and, for compressed messages, the
+// inflated payload as well. A message over the limit fails the read with
+// ErrReadLimit and the connection is closed with CloseMessageTooBig. Zero
+// means no limit. It must not be called concurrently with a read.
+func (c *Conn) SetReadLimit(limit int64) {
+	c.readLimit = limit
+}
+
+// SetFrameLimit is like SetReadLimit for the payload of a single frame,
+// failing with ErrFrameTooBig.
+func (c *Conn) SetFrameLimit(limit int64) {
+	c.frameLimit = limit
+}
+
+// failRead sends a close frame with code to the peer and returns err,
+// which ends reading. The peer gets the close timeout to take the frame.
+func (c *Conn) failRead(code int, err error) error {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.closeTimeout))
+	c.writeFrame(CloseMessage, formatCloseMessage(code, err.Error()), true, false)
+	return err
+}
+
+// checkFrame validates a frame header against RFC 6455, section 5.
+// inMessage reports whether a fragmented message is in progress.
+func (c *Conn) checkFrame(frame *Frame, inMessage bool) error {
+	if frame.Mask != c.isServer {
+		if c.isServer {
+			return ErrUnmaskedFrame
+		}
+		return ErrMaskedFrame
+	}
+	if frame.RSV[1] || frame.RSV[2] {
+		return ErrReservedBits
+	}
+	switch frame.OpCode {
+	case TextMessage, BinaryMessage:
+		if inMessage {
+			return ErrInterleavedData
+		}
+		if frame.RSV[0] && !c.compress {
+			return ErrReservedBits
+		}
+		return nil
+	case ContinuationMessage:
+		if !inMessage {
+			return ErrUnexpectedContinuation
+		}
+	case CloseMessage, PingMessage, PongMessage:
+		if !frame.FIN {
+			return ErrFragmentedControl
+		}
+		if frame.Length > 125 {
+			return ErrControlTooLong
+		}
+	default:
+		return ErrUnknownOpCode
+	}
+	if frame.RSV[0] {
+		return ErrReservedBits
+	}
+	return nil
+}
+
+// setTimeouts sets the message-level timeouts. idle bounds the wait for
+// the first byte of the next frame, read the time to receive the rest of
+// it once it has started, and write the time to send each frame. Zero
+// disables a timeout.
+func (c *Conn) setTimeouts(read, write, idle time.Duration) {
+	c.readTimeout = read
+	c.writeTimeout = write
+	c.idleTimeout = idle
+}
+
+// beginRead waits for the next frame under the idle timeout and then
+// arms the read timeout for it.
+func (c *Conn) beginRead() error {
+	if c.readTimeout <= 0 && c.idleTimeout <= 0 {
+		return nil
+	}
+	var deadline time.Time
+	if c.idleTimeout > 0 {
+		deadline = time.Now().Add(c.idleTimeout)
+	}
+	c.Conn.SetReadDeadline(deadline)
+	if _, err := c.br.Peek(1); err != nil {
+		if c.idleTimeout > 0 && isTimeout(err) {
+			return ErrIdleTimeout
+		}
+		return err
+	}
+	deadline = time.Time{}
+	if c.readTimeout > 0 {
+		deadline = time.Now().Add(c.readTimeout)
+	}
+	return c.Conn.SetReadDeadline(deadline)
+}
+
+// readError reports a deadline hit while the read timeout is armed as
+// ErrReadTimeout.
+func (c *Conn) readError(err error) error {
+	if c.readTimeout > 0 && isTimeout(err) {
+		return ErrReadTimeout
+	}
+	return err
+}
+
+// keepalive sends a ping every interval. If timeout is positive and no
+// pong arrives within timeout of a ping, the connection is closed with
+// CloseGoingAway. Pongs are only seen while the connection is being read.
+func (c *Conn) keepalive(interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		select {
+		case <-c.pong:
+		default:
+		}
+		if err := c.writeFrame(PingMessage, nil, true, false); err != nil {
+			// Once a close frame is out, the close handshake decides
+			// when the connection goes.
+			if err != ErrCloseSent {
+				c.Close()
+			}
+			return
+		}
+		if timeout <= 0 {
+			continue
+		}
+		timer := time.NewTimer(timeout)
+		select {
+		case <-c.done:
+			timer.Stop()
+			return
+		case <-c.pong:
+			timer.Stop()
+		case <-timer.C:
+			if c.writeFrame(CloseMessage, formatCloseMessage(CloseGoingAway, "pong timeout"), true, false) != ErrCloseSent {
+				c.Close()
+			}
+			return
+		}
+	}
+}
+
+// startKeepalive starts the keepalive loop if interval is positive.
+func (c *Conn) startKeepalive(interval, timeout time.Duration) {
+	if interval > 0 {
+		go c.keepalive(interval, timeout)
+	}
+}
+
+// advanceFrame reads frame headers until a data frame arrives, consuming
+// the control frames in between. Frames that break the protocol fail the
+// connection with CloseProtocolError.
+func (c *Conn) advanceFrame() (*Frame, error) {
+	inMessage := c.reader != nil
+	frame := &c.frame
+	for {
+		err := c.beginRead()
+		if err == nil {
+			err = decodeFrameHeader(c.br, frame, c.readScratch[:])
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, &CloseError{Code: CloseAbnormalClosure, Text: err.Error()}
+		}
+		switch err {
+		case nil:
+		case ErrFrameTooBig:
+			return nil, c.failRead(CloseMessageTooBig, err)
+		case ErrBadLength, ErrNonMinimalLength:
+			return nil, c.failRead(CloseProtocolError, err)
+		default:
+			return nil, c.readError(err)
+		}
+		if err := c.checkFrame(frame, inMessage); err != nil {
+			return nil, c.failRead(CloseProtocolError, err)
+		}
+		if !isControl(frame.OpCode) {
+			if c.frameLimit > 0 && int64(frame.Length) > c.frameLimit {
+				return nil, c.failRead(CloseMessageTooBig, ErrFrameTooBig)
+			}
+			return frame, nil
+		}
+		frame.Payload = c.controlBuf[:frame.Length]
+		if _, err := io.ReadFull(c.br, frame.Payload); err != nil {
+			return nil, c.readError(err)
+		}
+		if frame.Mask {
+			maskBytes(frame.MaskingKey, 0, frame.Payload)
+		}
+		switch frame.OpCode {
+		case CloseMessage:
+			cerr := parseCloseMessage(frame.Payload)
+			if len(frame.Payload) == 1 || len(frame.Payload) > 1 && !isSendableCloseCode(cerr.Code) {
+				return nil, c.failRead(CloseProtocolError, ErrBadClosePayload)
+			}
+			if !c.skipUTF8 && !utf8.ValidString(cerr.Text) {
+				return nil, c.failRead(CloseInvalidFramePayloadData, ErrInvalidUTF8)
+			}
+			echo := []byte{}
+			if cerr.Code != CloseNoStatusReceived {
+				echo = formatCloseMessage(cerr.Code, "")
+			}
+			if err := c.writeFrame(CloseMessage, echo, true, false); err != nil && err != ErrCloseSent {
+				return nil, err
+			}
+			return nil, cerr
+		case PingMessage:
+			if err := c.writeFrame(PongMessage, frame.Payload, true, false); err != nil {
+				return nil, err
+			}
+		case PongMessage:
+			select {
+			case c.pong <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// beginFrame starts reading the payload of a data frame, checking it
+// against the read limit first.
+func (c *Conn) beginFrame(frame *Frame) error {
+	c.readLength += int64(frame.Length)
+	if c.readLimit > 0 && c.readLength > c.readLimit {
+		return c.failRead(CloseMessageTooBig, ErrReadLimit)
+	}
+	c.readFinal = frame.FIN
+	c.readRemaining = frame.Length
+	c.readMask = frame.Mask
+	c.readMaskKey = frame.MaskingKey
+	c.readMaskPos = 0
+	return nil
+}
+
+// NextReader returns the opcode and a reader for the next data message.
+// The payload is streamed across fragment boundaries; any unread part of
+// the previous message is discarded. When the peer closes the connection
+// the error is a *CloseError.
+func (c *Conn) NextReader() (opcode byte, r io.Reader, err error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	return c.nextReader(&messageReader{c: c})
+}
+
+// nextReader starts the next message, to be read through r unless it is
+// compressed.
+func (c *Conn) nextReader(r *messageReader) (byte, io.Reader, error) {
+	if c.readerFull != nil {
+		var p [512]byte
+		for {
+			if _, err := c.readerFull.read(p[:]); err != nil {
+				break
+			}
+		}
+		c.readerFull = nil
+	}
+	c.drainReader()
+	if c.readErr != nil {
+		return 0, nil, c.readErr
+	}
+	frame, err := c.advanceFrame()
+	if err != nil {
+		c.readErr = err
+		return 0, nil, err
+	}
+	c.readLength, c.readInflated = 0, 0
+	c.readText = frame.OpCode == TextMessage && !c.skipUTF8
+	c.readUTF8.reset()
+	if err := c.beginFrame(frame); err != nil {
+		c.readErr = err
+		return 0, nil, err
+	}
+	c.reader = r
+	c.readerFull = c.reader
+	if frame.RSV[0] && c.compress {
+		fr := c.newFlateReader(c.reader)
+		c.readerFull = fr
+		return frame.OpCode, fr, nil
+	}
+	return frame.OpCode, c.reader, nil
+}
+
+// drainReader discards the rest of the raw message being read, if any.
+func (c *Conn) drainReader() error {
+	if c.reader == nil {
+		return nil
+	}
+	var p [512]byte
+	for c.reader != nil {
+		if _, err := c.reader.read(p[:]); err != nil {
+			c.reader = nil
+			if err != io.EOF {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ReadMessage reads the next complete data message, reassembling
+// continuation frames. Control frames received in between are consumed.
+func (c *Conn) ReadMessage() (opcode byte, payload []byte, err error) {
+	c.readMu.Lock()
+	// The reader never leaves ReadMessage, so the Conn's own can be used.
+	opcode, r, err := c.nextReader(&c.ownReader)
+	size := -1
+	if err == nil && c.readerFull == c.reader && c.readFinal && c.readRemaining <= maxPayloadPrealloc {
+		size = c.readRemaining
+	}
+	c.readMu.Unlock()
+	if err != nil {
+		return 0, nil, err
+	}
+	if size >= 0 {
+		// A single uncompressed frame is read straight into the result.
+		payload = make([]byte, size)
+		if _, err = io.ReadFull(r, payload); err == nil {
+			// Reach the end of the message to run its final checks.
+			if _, err = r.Read(payload[:0]); err == io.EOF {
+				err = nil
+			}
+		} else if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		return opcode, payload, nil
+	}
+	buf := readBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	_, err = buf.ReadFrom(r)
+	payload = make([]byte, buf.Len())
+	copy(payload, buf.Bytes())
+	if buf.Cap() <= maxPooledBufferSize {
+		readBufferPool.Put(buf)
+	}
+	return opcode, payload, err
+}
+
+// reader is implemented by the message readers; read is Read without
+// taking readMu.
+type reader interface {
+	read(p []byte) (int, error)
+}
+
+type messageReader struct {
+	c *Conn
+}
+
+func (r *messageReader) Read(p []byte) (int, error) {
+	r.c.readMu.Lock()
+	defer r.c.readMu.Unlock()
+	n, err := r.read(p)
+	r.c.readCond.Broadcast()
+	return n, err
+}
+
+func (r *messageReader) read(p []byte) (int, error) {
+	c := r.c
+	for c.reader == r {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		if c.readRemaining > 0 {
+			if len(p) > c.readRemaining {
+				p = p[:c.readRemaining]
+			}
+			n, err := c.br.Read(p)
+			c.readRemaining -= n
+			if c.readMask {
+				c.readMaskPos = maskBytes(c.readMaskKey, c.readMaskPos, p[:n])
+			}
+			if c.readerFull == r {
+				if uerr := c.checkUTF8(p[:n], false); uerr != nil {
+					c.readErr = uerr
+					return 0, uerr
+				}
+			}
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			if err != nil {
+				err = c.readError(err)
+				c.readErr = err
+			}
+			return n, err
+		}
+		if c.readFinal {
+			c.reader = nil
+			if c.readerFull == r {
+				c.readerFull = nil
+				if err := c.checkUTF8(nil, true); err != nil {
+					c.readErr = err
+					return 0, err
+				}
+			}
+			break
+		}
+		frame, err := c.advanceFrame()
+		if err != nil {
+			c.readErr = err
+			return 0, err
+		}
+		if err := c.beginFrame(frame); err != nil {
+			c.readErr = err
+			return 0, err
+		}
+	}
+	return 0, io.EOF
+}
+
+// NextWriter returns a writer for the next data message. Payload is
+// buffered and sent as continuation frames whenever the buffer fills; the
+// final frame is sent on Close. NextWriter blocks while another data
+// message is being written, so the writer must always be closed.
+func (c *Conn) NextWriter(opcode byte) (io.WriteCloser, error) {
+	if opcode != TextMessage && opcode != BinaryMessage {
+		return nil, ErrUnknownOpCode
+	}
+	c.dataMu.Lock()
+	w := &messageWriter{c: c, opcode: opcode}
+	if c.writeBufferSize == defaultWriteBufferSize {
+		w.pooled = writeBufferPool.Get().(*[]byte)
+		w.buf = (*w.pooled)[:0]
+	} else {
+		w.buf = make([]byte, 0, c.writeBufferSize)
+	}
+	if c.compress {
+		c.beginCompress(w)
+	}
+	return w, nil
+}
+
+// WriteMessage writes payload as a single unfragmented frame. When
+// compression is negotiated data messages go through NextWriter instead.
+func (c *Conn) WriteMessage(opcode byte, payload []byte) error {
+	switch opcode {
+	case TextMessage, BinaryMessage:
+		if c.compress {
+			w, err := c.NextWriter(opcode)
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(payload); err != nil {
+				w.Close()
+				return err
+			}
+			return w.Close()
+		}
+		c.dataMu.Lock()
+		defer c.dataMu.Unlock()
+	case CloseMessage, PingMessage, PongMessage:
+		if len(payload) > 125 {
+			return ErrControlTooLong
+		}
+	default:
+		return ErrUnknownOpCode
+	}
+	return c.writeFrame(opcode, payload, true, false)
+}
+
+func (c *Conn) writeFrame(opcode byte, payload []byte, fin, rsv1 bool) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	if opcode == CloseMessage {
+		c.closeSent = true
+	}
+	frame := Frame{FIN: fin, OpCode: opcode, Length: len(payload), Mask: !c.isServer}
+	frame.RSV[0] = rsv1
+	if frame.Mask {
+		var err error
+		if frame.MaskingKey, err = c.newMaskKey(); err != nil {
+			return err
+		}
+	}
+	if c.writeTimeout <= 0 {
+		return c.sendFrame(&frame, payload)
+	}
+	c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	if err := c.sendFrame(&frame, payload); err != nil {
+		if isTimeout(err) {
+			// Part of the frame may be on the wire; the stream is lost.
+			c.Close()
+			return ErrWriteTimeout
+		}
+		return err
+	}
+	return nil
+}
+
+// newMaskKey returns the next masking key from a batch read from
+// crypto/rand. writeMu must be held.
+func (c *Conn) newMaskKey() ([4]byte, error) {
+	var key [4]byte
+	if c.maskPos == 0 {
+		if _, err := io.ReadFull(rand.Reader, c.maskKeys[:]); err != nil {
+			return key, err
+		}
+	}
+	copy(key[:], c.maskKeys[c.maskPos:])
+	c.maskPos = (c.maskPos + len(key)) % len(c.maskKeys)
+	return key, nil
+}
+
+// sendFrame writes frame with payload through the connection's buffered
+// writer, masking it there rather than in a copy. writeMu must be held.
+func (c *Conn) sendFrame(frame *Frame, payload []byte) error {
+	n := encodeFrameHeader(c.writeHeader[:], frame)
+	c.bw.Write(c.writeHeader[:n])
+	if !frame.Mask {
+		c.bw.Write(payload)
+		return c.bw.Flush()
+	}
+	pos := 0
+	for len(payload) > 0 {
+		if c.bw.Available() == 0 {
+			if err := c.bw.Flush(); err != nil {
+				return err
+			}
+		}
+		b := c.bw.AvailableBuffer()
+		b = b[:copy(b[:cap(b)], payload)]
+		pos = maskBytes(frame.MaskingKey, pos, b)
+		c.bw.Write(b)
+		payload = payload[len(b):]
+	}
+	return c.bw.Flush()
+}
+
+type messageWriter struct {
+	c        *Conn
+	opcode   byte
+	rsv1     bool
+	compress bool
+	buf      []byte
+	pooled   *[]byte
+	closed   bool
+}
+
+func (w *messageWriter) flushFrame(fin bool) error {
+	err := w.c.writeFrame(w.opcode, w.buf, fin, w.rsv1)
+	w.opcode = ContinuationMessage
+	w.rsv1 = false
+	w.buf = w.buf[:0]
+	return err
+}
+
+// writeRaw buffers payload bytes as they go on the wire, sending a
+// continuation frame whenever the buffer is full.
+func (w *messageWriter) writeRaw(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flushFrame(false); err != nil {
+				return n, err
+			}
+		}
+		m := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+m]
+		n += m
+		p = p[m:]
+	}
+	return n, nil
+}
+
+func (w *messageWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, ErrWriterClosed
+	}
+	if w.compress {
+		return w.c.flateWriter.Write(p)
+	}
+	return w.writeRaw(p)
+}
+
+func (w *messageWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	defer w.c.dataMu.Unlock()
+	if w.pooled != nil {
+		defer writeBufferPool.Put(w.pooled)
+	}
+	if w.compress {
+		if err := w.c.endCompress(); err != nil {
+			return err
+		}
+	}
+	return w.flushFrame(true)
+}
@@ -0,0 +1,647 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestConnPair() (*Conn, *Conn) {
+	c1, c2 := net.Pipe()
+	return newConn(c1, nil, false), newConn(c2, nil, true)
+}
+
+// writeTestFrames writes raw frames from a goroutine; the pipe is closed
+// by the test when it is done, which unblocks any unread frames.
+func writeTestFrames(conn net.Conn, frames ...*Frame) {
+	go func() {
+		for _, frame := range frames {
+			frame.Length = len(frame.Payload)
+			if err := writeFrame(conn, frame); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// discardFrames reads and drops frames, such as pongs, sent to conn.
+func discardFrames(conn *Conn) {
+	for {
+		if _, err := readFrame(conn.br); err != nil {
+			return
+		}
+	}
+}
+
+func TestConnMessageRoundTrip(t *testing.T) {
+	client, server := newTestConnPair()
+	defer client.Close()
+	defer server.Close()
+	for _, payload := range [][]byte{{}, []byte("hello world!"), bytes.Repeat([]byte{0xaa}, 125), bytes.Repeat([]byte{0xbb}, 126), bytes.Repeat([]byte{0xcc}, 70000)} {
+		go func() {
+			if err := client.WriteMessage(BinaryMessage, payload); err != nil {
+				t.Error(err)
+			}
+		}()
+		opcode, got, err := server.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opcode != BinaryMessage || !bytes.Equal(got, payload) {
+			t.Fatalf("got opcode %d len %d, want %d len %d", opcode, len(got), BinaryMessage, len(payload))
+		}
+	}
+}
+
+func TestConnReadMessageFragmented(t *testing.T) {
+	client, server := newTestConnPair()
+	defer client.Close()
+	defer server.Close()
+	go discardFrames(server)
+	writeTestFrames(server.Conn,
+		&Frame{OpCode: TextMessage, Payload: []byte("Hel")},
+		&Frame{FIN: true, OpCode: PingMessage, Payload: []byte("ping")},
+		&Frame{OpCode: ContinuationMessage, Payload: []byte("lo ")},
+		&Frame{FIN: true, OpCode: ContinuationMessage, Payload: []byte("world")},
+	)
+	opcode, payload, err := client.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opcode != TextMessage || string(payload) != "Hello world" {
+		t.Fatalf("got %d %q", opcode, payload)
+	}
+}
+
+func TestConnReadMessageErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames []*Frame
+		err    error
+	}{
+		{"continuation", []*Frame{{FIN: true, OpCode: ContinuationMessage}}, ErrUnexpectedContinuation},
+		{"interleaved", []*Frame{{OpCode: TextMessage}, {FIN: true, OpCode: BinaryMessage}}, ErrInterleavedData},
+		{"fragmented control", []*Frame{{OpCode: PingMessage}}, ErrFragmentedControl},
+		{"long control", []*Frame{{FIN: true, OpCode: PingMessage, Payload: make([]byte, 126)}}, ErrControlTooLong},
+		{"unknown opcode", []*Frame{{FIN: true, OpCode: 0x03}}, ErrUnknownOpCode},
+		{"unknown control opcode", []*Frame{{FIN: true, OpCode: 0x0b}}, ErrUnknownOpCode},
+		{"rsv1 without extension", []*Frame{{FIN: true, RSV: [3]bool{true}, OpCode: TextMessage}}, ErrReservedBits},
+		{"rsv2", []*Frame{{FIN: true, RSV: [3]bool{false, true}, OpCode: TextMessage}}, ErrReservedBits},
+		{"rsv3 on ping", []*Frame{{FIN: true, RSV: [3]bool{false, false, true}, OpCode: PingMessage}}, ErrReservedBits},
+		{"masked from server", []*Frame{{FIN: true, OpCode: TextMessage, Mask: true}}, ErrMaskedFrame},
+		{"one byte close", []*Frame{{FIN: true, OpCode: CloseMessage, Payload: []byte{0x03}}}, ErrBadClosePayload},
+		{"reserved close code", []*Frame{{FIN: true, OpCode: CloseMessage, Payload: []byte{0x03, 0xed}}}, ErrBadClosePayload},
+		{"close code 999", []*Frame{{FIN: true, OpCode: CloseMessage, Payload: []byte{0x03, 0xe7}}}, ErrBadClosePayload},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := newTestConnPair()
+			defer client.Close()
+			defer server.Close()
+			writeTestFrames(server.Conn, tt.frames...)
+			code := readCloseCode(server)
+			if _, _, err := client.ReadMessage(); err != tt.err {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if c := <-code; c != CloseProtocolError {
+				t.Fatalf("got close code %d, want %d", c, CloseProtocolError)
+			}
+		})
+	}
+}
+
+func TestConnReadMessageRawErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  []byte
+		err  error
+	}{
+		{"16-bit length under 126", []byte{0x82, 0x7e, 0x00, 0x7d}, ErrNonMinimalLength},
+		{"64-bit length under 65536", []byte{0x82, 0x7f, 0, 0, 0, 0, 0, 0, 0xff, 0xff}, ErrNonMinimalLength},
+		{"64-bit length msb", []byte{0x82, 0x7f, 0x80, 0, 0, 0, 0, 0, 0, 0}, ErrBadLength},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := newTestConnPair()
+			defer client.Close()
+			defer server.Close()
+			go server.Conn.Write(tt.raw)
+			code := readCloseCode(server)
+			if _, _, err := client.ReadMessage(); err != tt.err {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if c := <-code; c != CloseProtocolError {
+				t.Fatalf("got close code %d, want %d", c, CloseProtocolError)
+			}
+		})
+	}
+}
+
+func TestConnReadMessageTruncated(t *testing.T) {
+	for _, raw := range [][]byte{
+		{0x82, 0x05},
+		{0x82, 0x05, 'a', 'b'},
+	} {
+		c := newConn(&fuzzConn{r: bytes.NewReader(raw)}, nil, false)
+		if _, payload, err := c.ReadMessage(); err != io.ErrUnexpectedEOF || payload != nil {
+			t.Errorf("% x: got %q, %v", raw, payload, err)
+		}
+	}
+}
+
+func TestConnServerRejectsUnmasked(t *testing.T) {
+	client, server := newTestConnPair()
+	defer client.Close()
+	defer server.Close()
+	writeTestFrames(client.Conn, &Frame{FIN: true, OpCode: TextMessage, Payload: []byte("hi")})
+	code := readCloseCode(client)
+	if _, _, err := server.ReadMessage(); err != ErrUnmaskedFrame {
+		t.Fatalf("got %v, want %v", err, ErrUnmaskedFrame)
+	}
+	if c := <-code; c != CloseProtocolError {
+		t.Fatalf("got close code %d, want %d", c, CloseProtocolError)
+	}
+}
+
+// readCloseCode reads frames from conn until a close frame and returns its
+// status code, or 0 if the connection ends first.
+func readCloseCode(conn *Conn) <-chan int {
+	code := make(chan int, 1)
+	go func() {
+		defer close(code)
+		for {
+			frame, err := readFrame(conn.br)
+			if err != nil {
+				return
+			}
+			if frame.OpCode == CloseMessage {
+				code <- int(binary.BigEndian.Uint16(frame.Payload))
+				return
+			}
+		}
+	}()
+	return code
+}
+
+func TestConnReadLimits(t *testing.T) {
+	tests := []struct {
+		name       string
+		frameLimit int64
+		readLimit  int64
+		raw        []byte
+		frames     []*Frame
+		err        error
+	}{
+		{"frame", 10, 0, nil, []*Frame{{FIN: true, OpCode: BinaryMessage, Payload: make([]byte, 11)}}, ErrFrameTooBig},
+		{"message", 0, 10, nil, []*Frame{{OpCode: BinaryMessage, Payload: make([]byte, 6)}, {FIN: true, OpCode: ContinuationMessage, Payload: make([]byte, 6)}}, ErrReadLimit},
+		{"huge header", 1 << 20, 0, []byte{0x82, 0x7f, 0x40, 0, 0, 0, 0, 0, 0, 0}, nil, ErrFrameTooBig},
+		{"huge message", 0, 1 << 20, []byte{0x82, 0x7f, 0x40, 0, 0, 0, 0, 0, 0, 0}, nil, ErrReadLimit},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := newTestConnPair()
+			defer client.Close()
+			defer server.Close()
+			client.SetFrameLimit(tt.frameLimit)
+			client.SetReadLimit(tt.readLimit)
+			if tt.raw != nil {
+				go server.Conn.Write(tt.raw)
+			} else {
+				writeTestFrames(server.Conn, tt.frames...)
+			}
+			code := readCloseCode(server)
+			if _, _, err := client.ReadMessage(); err != tt.err {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if c := <-code; c != CloseMessageTooBig {
+				t.Fatalf("got close code %d, want %d", c, CloseMessageTooBig)
+			}
+		})
+	}
+}
+
+func TestConnNextWriterFragments(t *testing.T) {
+	client, server := newTestConnPair()
+	defer client.Close()
+	defer server.Close()
+	client.writeBufferSize = 16
+	payload := bytes.Repeat([]byte("0123456789"), 5)
+	go func() {
+		w, err := client.NextWriter(BinaryMessage)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		for i := 0; i < len(payload); i += 7 {
+			end := i + 7
+			if end > len(payload) {
+				end = len(payload)
+			}
+			if _, err := w.Write(payload[i:end]); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	var got []byte
+	for opcode := BinaryMessage; ; opcode = ContinuationMessage {
+		frame, err := readFrame(server.br)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.OpCode != opcode || !frame.Mask || frame.Length > 16 {
+			t.Fatalf("unexpected frame %+v", frame)
+		}
+		got = append(got, frame.Payload...)
+		if frame.FIN {
+			break
+		}
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("got %q, want %q", got, payload)
+	}
+}
+
+func TestConnConcurrentWriters(t *testing.T) {
+	client, server := newTestConnPair()
+	defer client.Close()
+	defer server.Close()
+	server.writeBufferSize = 16
+	// The client answers pings; drain the pongs.
+	go func() {
+		for {
+			if _, _, err := server.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	const writers, messages = 8, 20
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			payload := bytes.Repeat([]byte{byte('a' + i)}, 50+i)
+			for j := 0; j < messages; j++ {
+				var err error
+				switch j % 3 {
+				case 0:
+					err = server.WriteMessage(BinaryMessage, payload)
+				case 1:
+					var w io.WriteCloser
+					if w, err = server.NextWriter(BinaryMessage); err == nil {
+						w.Write(payload[:10])
+						w.Write(payload[10:])
+						err = w.Close()
+					}
+				case 2:
+					err = server.WriteMessage(PingMessage, []byte{byte(i)})
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+
+	want := writers * (messages - messages/3)
+	for n := 0; n < want; n++ {
+		_, p, err := client.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(p) < 50 || !bytes.Equal(p, bytes.Repeat(p[:1], 50+int(p[0]-'a'))) {
+			t.Fatalf("interleaved message %q", p)
+		}
+	}
+	wg.Wait()
+}
+
+func TestConnNextReaderStreams(t *testing.T) {
+	client, server := newTestConnPair()
+	defer client.Close()
+	defer server.Close()
+	server.writeBufferSize = 1000
+	payload := bytes.Repeat([]byte{0x5a}, 10000)
+	go func() {
+		w, err := server.NextWriter(BinaryMessage)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		w.Write(payload)
+		w.Close()
+		server.WriteMessage(TextMessage, []byte("next"))
+	}()
+	opcode, r, err := client.NextReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []byte
+	p := make([]byte, 333)
+	for {
+		n, err := r.Read(p)
+		got = append(got, p[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if opcode != BinaryMessage || !bytes.Equal(got, payload) {
+		t.Fatalf("got opcode %d len %d", opcode, len(got))
+	}
+	opcode, next, err := client.ReadMessage()
+	if err != nil || opcode != TextMessage || string(next) != "next" {
+		t.Fatalf("got %d %q %v", opcode, next, err)
+	}
+}
+
+func TestConnAnswersPing(t *testing.T) {
+	client, server := newTestConnPair()
+	defer client.Close()
+	defer server.Close()
+	go client.ReadMessage()
+	writeTestFrames(server.Conn, &Frame{FIN: true, OpCode: PingMessage, Payload: []byte("abc")})
+	frame, err := readFrame(server.br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.OpCode != PongMessage || !frame.Mask || string(frame.Payload) != "abc" {
+		t.Fatalf("unexpected frame %+v", frame)
+	}
+}
+
+func TestConnKeepalive(t *testing.T) {
+	client, server := newTestConnPair()
+	defer client.Close()
+	defer server.Close()
+	client.startKeepalive(10*time.Millisecond, 100*time.Millisecond)
+	messages := make(chan []byte)
+	go func() {
+		for {
+			_, payload, err := client.ReadMessage()
+			if err != nil {
+				close(messages)
+				return
+			}
+			messages <- payload
+		}
+	}()
+	go echoHandler(server, nil)
+	time.Sleep(200 * time.Millisecond)
+	if err := client.WriteMessage(TextMessage, []byte("alive")); err != nil {
+		t.Fatal(err)
+	}
+	if payload := <-messages; string(payload) != "alive" {
+		t.Fatalf("got %q", payload)
+	}
+}
+
+func TestConnKeepaliveTimeout(t *testing.T) {
+	client, server := newTestConnPair()
+	defer client.Close()
+	defer server.Close()
+	client.startKeepalive(10*time.Millisecond, 20*time.Millisecond)
+	for {
+		frame, err := readFrame(server.br)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.OpCode == PingMessage {
+			continue
+		}
+		if frame.OpCode != CloseMessage || binary.BigEndian.Uint16(frame.Payload) != CloseGoingAway {
+			t.Fatalf("unexpected frame %+v", frame)
+		}
+		break
+	}
+	if _, _, err := client.ReadMessage(); err == nil {
+		t.Fatal("connection still open")
+	}
+}
+
+func TestConnKeepaliveCloseHandshake(t *testing.T) {
+	client, server := newTestConnPair()
+	defer server.Close()
+	client.startKeepalive(10*time.Millisecond, 0)
+	echoed := make(chan error, 1)
+	go func() {
+		for {
+			frame, err := readFrame(server.br)
+			if err != nil {
+				echoed <- err
+				return
+			}
+			if frame.OpCode == CloseMessage {
+				// Let the keepalive tick a few times before answering.
+				time.Sleep(100 * time.Millisecond)
+				echoed <- server.writeFrame(CloseMessage, frame.Payload, true, false)
+				return
+			}
+		}
+	}()
+	time.Sleep(30 * time.Millisecond)
+	start := time.Now()
+	if err := client.CloseWithCode(CloseNormalClosure, ""); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Fatalf("closed after %v, before the peer answered", d)
+	}
+	if err := <-echoed; err != nil {
+		t.Fatalf("echo failed: %v", err)
+	}
+}
+
+func TestConnReadTimeout(t *testing.T) {
+	client, server := newTestConnPair()
+	defer client.Close()
+	defer server.Close()
+	server.setTimeouts(50*time.Millisecond, 0, time.Second)
+	// A peer trickling a frame is cut off by the read timeout even though
+	// bytes keep arriving within the idle timeout.
+	go func() {
+		for _, b := range []byte{0x82, 0x85, 0, 0, 0, 0, 'a', 'b'} {
+			if _, err := client.Conn.Write([]byte{b}); err != nil {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+	if _, _, err := server.ReadMessage(); err != ErrReadTimeout {
+		t.Fatalf("got %v, want %v", err, ErrReadTimeout)
+	}
+}
+
+func TestConnIdleTimeout(t *testing.T) {
+	client, server := newTestConnPair()
+	defer client.Close()
+	defer server.Close()
+	server.setTimeouts(0, 0, 50*time.Millisecond)
+	go func() {
+		for i := 0; i < 3; i++ {
+			time.Sleep(20 * time.Millisecond)
+			client.WriteMessage(TextMessage, []byte("tick"))
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		if _, _, err := server.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, _, err := server.ReadMessage()
+	if err != ErrIdleTimeout {
+		t.Fatalf("got %v, want %v", err, ErrIdleTimeout)
+	}
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Fatalf("%v is not a timeout", err)
+	}
+}
+
+func TestConnWriteTimeout(t *testing.T) {
+	client, server := newTestConnPair()
+	defer client.Close()
+	defer server.Close()
+	server.setTimeouts(0, 20*time.Millisecond, 0)
+	if err := server.WriteMessage(TextMessage, []byte("unread")); err != ErrWriteTimeout {
+		t.Fatalf("got %v, want %v", err, ErrWriteTimeout)
+	}
+}
+
+// benchConn discards writes and replays frame forever on reads.
+type benchConn struct {
+	net.Conn
+	frame []byte
+	pos   int
+}
+
+func (c *benchConn) Read(p []byte) (int, error) {
+	n := copy(p, c.frame[c.pos:])
+	c.pos = (c.pos + n) % len(c.frame)
+	return n, nil
+}
+
+func (c *benchConn) Write(p []byte) (int, error) { return len(p), nil }
+
+var benchSizes = []struct {
+	name string
+	size int
+}{{"16B", 16}, {"1KB", 1 << 10}, {"64KB", 64 << 10}}
+
+func BenchmarkWriteMessage(b *testing.B) {
+	for _, role := range []string{"server", "client"} {
+		for _, bs := range benchSizes {
+			b.Run(role+"/"+bs.name, func(b *testing.B) {
+				c := newConn(&benchConn{}, nil, role == "server")
+				payload := make([]byte, bs.size)
+				b.SetBytes(int64(bs.size))
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if err := c.WriteMessage(BinaryMessage, payload); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkNextWriter(b *testing.B) {
+	for _, bs := range benchSizes {
+		b.Run(bs.name, func(b *testing.B) {
+			c := newConn(&benchConn{}, nil, true)
+			payload := make([]byte, bs.size)
+			b.SetBytes(int64(bs.size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				w, err := c.NextWriter(BinaryMessage)
+				if err != nil {
+					b.Fatal(err)
+				}
+				w.Write(payload)
+				if err := w.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkReadMessage(b *testing.B) {
+	for _, bs := range benchSizes {
+		b.Run(bs.name, func(b *testing.B) {
+			var frame bytes.Buffer
+			writeFrame(&frame, &Frame{FIN: true, OpCode: BinaryMessage, Length: bs.size, Mask: true, MaskingKey: [4]byte{1, 2, 3, 4}, Payload: make([]byte, bs.size)})
+			c := newConn(&benchConn{frame: frame.Bytes()}, nil, true)
+			b.SetBytes(int64(bs.size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := c.ReadMessage(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkNextReader(b *testing.B) {
+	for _, bs := range benchSizes {
+		b.Run(bs.name, func(b *testing.B) {
+			var frame bytes.Buffer
+			writeFrame(&frame, &Frame{FIN: true, OpCode: BinaryMessage, Length: bs.size, Mask: true, MaskingKey: [4]byte{1, 2, 3, 4}, Payload: make([]byte, bs.size)})
+			c := newConn(&benchConn{frame: frame.Bytes()}, nil, true)
+			p := make([]byte, 4096)
+			b.SetBytes(int64(bs.size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, r, err := c.NextReader()
+				if err != nil {
+					b.Fatal(err)
+				}
+				for {
+					if _, err := r.Read(p); err != nil {
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestMaskBytes(t *testing.T) {
+	key := [4]byte{0x37, 0xfa, 0x21, 0x3d}
+	p := make([]byte, 100)
+	for i := range p {
+		p[i] = byte(i)
+	}
+	want := make([]byte, len(p))
+	for i := range p {
+		want[i] = p[i] ^ key[i&3]
+	}
+	// Masking in pieces of every size must match masking byte by byte.
+	for step := 1; step <= len(p); step++ {
+		got := append([]byte(nil), p...)
+		pos := 0
+		for i := 0; i < len(got); i += step {
+			end := i + step
+			if end > len(got) {
+				end = len(got)
+			}
+			pos = maskBytes(key, pos, got[i:end])
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("step %d: got %x, want %x", step, got, want)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// fuzzConn reads from r and records what is written to it.
+type fuzzConn struct {
+	net.Conn
+	r       io.Reader
+	written bytes.Buffer
+}
+
+func (c *fuzzConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c *fuzzConn) Write(p []byte) (int, error)        { return c.written.Write(p) }
+func (c *fuzzConn) Close() error                       { return nil }
+func (c *fuzzConn) SetDeadline(t time.Time) error      { return nil }
+func (c *fuzzConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *fuzzConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func FuzzReadFrame(f *testing.F) {
+	for _, seed := range [][]byte{
+		{0x81, 0x05, 'H', 'e', 'l', 'l', 'o'},
+		{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58},
+		{0x01, 0x03, 'H', 'e', 'l', 0x80, 0x02, 'l', 'o'},
+		{0x89, 0x05, 'H', 'e', 'l', 'l', 'o'},
+		{0x82, 0x7e, 0x01, 0x00},
+		{0x82, 0x7f, 0, 0, 0, 0, 0, 1, 0, 0},
+		{0x82, 0x7f, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		{0x82, 0x7f, 0x80, 0, 0, 0, 0, 0, 0, 0},
+		{0x82, 0x7e, 0x00, 0x05, 'H', 'e', 'l', 'l', 'o'},
+		{0x88, 0x02, 0x03, 0xe8},
+		{0x88, 0x01, 0x03},
+		{0xc1, 0x07, 0xf2, 0x48, 0xcd, 0xc9, 0xc9, 0x07, 0x00},
+		{0x8b, 0x00},
+		{0x81},
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		frame, err := readFrame(r)
+		if err == nil {
+			// Lengths are minimally encoded, so a frame that parses must
+			// write back to the same bytes.
+			var buf bytes.Buffer
+			if err := writeFrame(&buf, frame); err != nil {
+				t.Fatal(err)
+			}
+			if consumed := data[:len(data)-r.Len()]; !bytes.Equal(buf.Bytes(), consumed) {
+				t.Fatalf("rewrote %x as %x", consumed, buf.Bytes())
+			}
+		}
+		for _, isServer := range []bool{false, true} {
+			c := newConn(&fuzzConn{r: bytes.NewReader(data)}, nil, isServer)
+			c.enableDeflate(&deflateParams{})
+			c.SetReadLimit(1 << 20)
+			for {
+				if _, _, err := c.ReadMessage(); err != nil {
+					break
+				}
+			}
+		}
+	})
+}
+
+func FuzzFrameRoundTrip(f *testing.F) {
+	f.Add(true, uint8(0), TextMessage, false, uint32(0), []byte("Hello"))
+	f.Add(false, uint8(4), BinaryMessage, true, uint32(0x37fa213d), bytes.Repeat([]byte{0xaa}, 126))
+	f.Add(true, uint8(7), PingMessage, true, uint32(1), []byte{})
+	f.Add(true, uint8(0), BinaryMessage, false, uint32(0), make([]byte, 65536))
+	f.Fuzz(func(t *testing.T, fin bool, rsv uint8, opcode uint8, mask bool, key uint32, payload []byte) {
+		frame := &Frame{
+			FIN:        fin,
+			RSV:        [3]bool{rsv&4 != 0, rsv&2 != 0, rsv&1 != 0},
+			OpCode:     opcode & 0x0f,
+			Length:     len(payload),
+			Mask:       mask,
+			MaskingKey: [4]byte{byte(key >> 24), byte(key >> 16), byte(key >> 8), byte(key)},
+			Payload:    payload,
+		}
+		if !mask {
+			frame.MaskingKey = [4]byte{}
+		}
+		var buf bytes.Buffer
+		if err := writeFrame(&buf, frame); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readFrame(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.FIN != frame.FIN || got.RSV != frame.RSV || got.OpCode != frame.OpCode ||
+			got.Length != frame.Length || got.Mask != frame.Mask || got.MaskingKey != frame.MaskingKey ||
+			!bytes.Equal(got.Payload, frame.Payload) {
+			t.Fatalf("got %+v, want %+v", got, frame)
+		}
+		if buf.Len() != 0 {
+			t.Fatalf("%d bytes left over", buf.Len())
+		}
+	})
+}
+
+func FuzzServerHandshake(f *testing.F) {
+	for _, seed := range []string{
+		"GET /ws HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n",
+		"GET /ws HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n" +
+			"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n" +
+			"Sec-WebSocket-Protocol: chat, superchat\r\n" +
+			"Sec-WebSocket-Extensions: permessage-deflate; client_max_window_bits, permessage-deflate; server_no_context_takeover\r\n\r\n",
+		"POST /ws HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"GET /ws HTTP/1.1\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 8\r\n\r\n",
+		"GET /ws HTTP/1.1\r\nSec-WebSocket-Extensions: ;;,=\"\r\n\r\n",
+		"\r\n\r\n",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		srv := &Server{}
+		srv.EnableCompression = true
+		srv.Subprotocols = []string{"chat"}
+		conn, req, err := srv.handshake(&fuzzConn{r: bytes.NewReader(data)})
+		if err != nil {
+			return
+		}
+		if req.Method != "GET" {
+			t.Fatalf("upgraded a %s request", req.Method)
+		}
+		if p := conn.Subprotocol(); p != "" && p != "chat" {
+			t.Fatalf("selected subprotocol %q", p)
+		}
+	})
+}
+
+func FuzzClientHandshake(f *testing.F) {
+	// {accept} is replaced with the accept value for the key the client
+	// sent, so that the fuzzer can get past the challenge.
+	for _, seed := range []string{
+		"HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: {accept}\r\n\r\n",
+		"HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: {accept}\r\n" +
+			"Sec-WebSocket-Protocol: chat\r\nSec-WebSocket-Extensions: permessage-deflate; server_no_context_takeover\r\n\r\n",
+		"HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: {accept}\r\n" +
+			"Sec-WebSocket-Extensions: permessage-deflate; client_max_window_bits=9\r\n\r\n",
+		"HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: bad\r\n\r\n",
+		"HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n",
+		"HTTP/1.0 101\r\n\r\n",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		cli, err := NewClient("ws://example.com/ws")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cli.EnableCompression = true
+		cli.Subprotocols = []string{"chat"}
+		conn := &fuzzConn{}
+		var resp io.Reader
+		conn.r = readerFunc(func(p []byte) (int, error) {
+			if resp == nil {
+				var accept string
+				if req, err := http.ReadRequest(bufio.NewReader(&conn.written)); err == nil {
+					accept, _ = genNonceAccept(req.Header.Get("Sec-WebSocket-Key"))
+				}
+				resp = bytes.NewReader(bytes.ReplaceAll(data, []byte("{accept}"), []byte(accept)))
+			}
+			return resp.Read(p)
+		})
+		if err := cli.handshake(conn); err != nil {
+			return
+		}
+		if cli.Conn == nil || cli.Response.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatal("handshake succeeded without a 101 response")
+		}
+		if p := cli.Conn.Subprotocol(); p != "" && p != "chat" {
+			t.Fatalf("accepted subprotocol %q", p)
+		}
+	})
+}
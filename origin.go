@@ -0,0 +1,63 @@
+package websocket
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CheckSameOrigin is the default Upgrader.CheckOrigin. It accepts a
+// request without an Origin header, as sent by non-browser clients, or
+// one whose Origin names the host the request was sent to.
+func CheckSameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// AllowOrigins returns a CheckOrigin function that accepts the origins
+// matching any of patterns, and requests without an Origin header. A
+// pattern is a host such as "example.com" or "example.com:8443", where
+// "*.example.com" matches every subdomain of example.com but not
+// example.com itself. A pattern may start with a scheme, as in
+// "https://example.com", to also require that scheme.
+func AllowOrigins(patterns ...string) func(*http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Host == "" {
+			return false
+		}
+		for _, pattern := range patterns {
+			if matchOrigin(pattern, u) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// matchOrigin reports whether the origin u matches pattern.
+func matchOrigin(pattern string, u *url.URL) bool {
+	if i := strings.Index(pattern, "://"); i >= 0 {
+		if !strings.EqualFold(pattern[:i], u.Scheme) {
+			return false
+		}
+		pattern = pattern[i+len("://"):]
+	}
+	host := strings.ToLower(u.Host)
+	pattern = strings.ToLower(pattern)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
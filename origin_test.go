@@ -0,0 +1,42 @@
+package websocket
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckOrigin(t *testing.T) {
+	allow := AllowOrigins("example.com", "https://*.example.org", "localhost:8080")
+	tests := []struct {
+		host, origin string
+		same, listed bool
+	}{
+		{"example.com", "", true, true},
+		{"example.com", "https://example.com", true, true},
+		{"EXAMPLE.com", "http://example.COM", true, true},
+		{"example.com", "https://evil.com", false, false},
+		{"example.com:8080", "https://example.com", false, true},
+		{"example.com", "null", false, false},
+		{"ws.example.org", "https://ws.example.org", true, true},
+		{"ws.example.org", "https://a.b.example.org", false, true},
+		{"ws.example.org", "http://a.example.org", false, false},
+		{"ws.example.org", "https://example.org", false, false},
+		{"ws.example.org", "https://evilexample.org", false, false},
+		{"localhost:8080", "http://localhost:8080", true, true},
+		{"localhost:8080", "http://localhost:8081", false, false},
+		{"example.com", "://bad", false, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = tt.host
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if got := CheckSameOrigin(r); got != tt.same {
+			t.Errorf("CheckSameOrigin(%q from %q) = %v", tt.host, tt.origin, got)
+		}
+		if got := allow(r); got != tt.listed {
+			t.Errorf("AllowOrigins(%q from %q) = %v", tt.host, tt.origin, got)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrBadProxyScheme = errors.New("unsupported proxy scheme")
+	ErrSOCKSAuth      = errors.New("socks5 proxy rejected authentication")
+)
+
+// proxyURL returns the proxy to use for cli.URL, if any.
+func (cli *Client) proxyURL() (*url.URL, error) {
+	if cli.Proxy != nil {
+		return cli.Proxy(cli.URL)
+	}
+	// http.ProxyFromEnvironment picks HTTP_PROXY or HTTPS_PROXY by the
+	// scheme of the request URL.
+	u := *cli.URL
+	u.Scheme = "http"
+	if secure, _ := isSecureScheme(cli.URL.Scheme); secure {
+		u.Scheme = "https"
+	}
+	return http.ProxyFromEnvironment(&http.Request{URL: &u})
+}
+
+// dialProxy connects to proxy and asks it for a tunnel to addr.
+func (cli *Client) dialProxy(ctx context.Context, proxy *url.URL, addr string) (net.Conn, error) {
+	port := proxy.Port()
+	switch proxy.Scheme {
+	case "http":
+		if port == "" {
+			port = "80"
+		}
+	case "https":
+		if port == "" {
+			port = "443"
+		}
+	case "socks5", "socks5h":
+		if port == "" {
+			port = "1080"
+		}
+	default:
+		return nil, &ConnectError{Phase: PhaseProxy, Err: ErrBadProxyScheme}
+	}
+	conn, err := cli.dialDirect(ctx, proxy.Hostname(), port)
+	if err != nil {
+		return nil, err
+	}
+	if proxy.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxy.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, phaseError(ctx, PhaseProxy, err)
+		}
+		conn = tlsConn
+	}
+	stop := watchContext(ctx, conn)
+	if strings.HasPrefix(proxy.Scheme, "socks5") {
+		err = socks5Connect(conn, proxy.User, addr)
+	} else {
+		err = httpConnect(conn, proxy.User, addr)
+	}
+	stop()
+	if err != nil {
+		conn.Close()
+		return nil, phaseError(ctx, PhaseProxy, err)
+	}
+	return conn, nil
+}
+
+// httpConnect opens a tunnel to addr with an HTTP CONNECT request.
+func httpConnect(conn net.Conn, user *url.Userinfo, addr string) error {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if user != nil {
+		password, _ := user.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("proxy refused CONNECT: " + resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return errors.New("proxy sent data before the tunnel was used")
+	}
+	return nil
+}
+
+// socks5Connect opens a tunnel to addr as described in RFC 1928, using
+// username/password authentication (RFC 1929) when user is set.
+func socks5Connect(conn net.Conn, user *url.Userinfo, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return err
+	}
+	method := byte(0x00)
+	if user != nil {
+		method = 0x02
+	}
+	if _, err := conn.Write([]byte{0x05, 0x01, method}); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 || reply[1] != method {
+		return errors.New("socks5 proxy offered no acceptable authentication method")
+	}
+	if user != nil {
+		password, _ := user.Password()
+		if len(user.Username()) > 255 || len(password) > 255 {
+			return ErrSOCKSAuth
+		}
+		p := []byte{0x01, byte(len(user.Username()))}
+		p = append(p, user.Username()...)
+		p = append(p, byte(len(password)))
+		p = append(p, password...)
+		if _, err := conn.Write(p); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return ErrSOCKSAuth
+		}
+	}
+
+	p := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			p = append(p, 0x01)
+			p = append(p, ip4...)
+		} else {
+			p = append(p, 0x04)
+			p = append(p, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return errors.New("socks5 host name too long")
+		}
+		p = append(p, 0x03, byte(len(host)))
+		p = append(p, host...)
+	}
+	p = append(p, byte(port>>8), byte(port))
+	if _, err := conn.Write(p); err != nil {
+		return err
+	}
+
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return err
+	}
+	if head[0] != 0x05 {
+		return errors.New("bad socks5 reply version")
+	}
+	if head[1] != 0x00 {
+		return errors.New("socks5 proxy refused connection: code " + strconv.Itoa(int(head[1])))
+	}
+	var skip int
+	switch head[3] {
+	case 0x01:
+		skip = net.IPv4len
+	case 0x04:
+		skip = net.IPv6len
+	case 0x03:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return err
+		}
+		skip = int(n[0])
+	default:
+		return errors.New("bad socks5 reply address type")
+	}
+	// Bound address and port.
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
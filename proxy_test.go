@@ -0,0 +1,144 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+// serveProxy accepts connections on a local port and hands each of them
+// to handshake, which returns the target address to tunnel to.
+func serveProxy(t *testing.T, handshake func(conn net.Conn) (string, error)) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				addr, err := handshake(conn)
+				if err != nil {
+					return
+				}
+				target, err := net.Dial("tcp", addr)
+				if err != nil {
+					return
+				}
+				defer target.Close()
+				go io.Copy(target, conn)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func httpConnectProxy(auth string) func(net.Conn) (string, error) {
+	return func(conn net.Conn) (string, error) {
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return "", err
+		}
+		if req.Method != "CONNECT" || req.Header.Get("Proxy-Authorization") != auth {
+			io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			return "", errors.New("unauthorized")
+		}
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		return req.Host, nil
+	}
+}
+
+func socks5Proxy(conn net.Conn) (string, error) {
+	br := bufio.NewReader(conn)
+	head := make([]byte, 3)
+	if _, err := io.ReadFull(br, head); err != nil || head[2] != 0x02 {
+		return "", errors.New("bad greeting")
+	}
+	conn.Write([]byte{0x05, 0x02})
+	br.ReadByte() // subnegotiation version
+	ulen, _ := br.ReadByte()
+	user := make([]byte, ulen)
+	io.ReadFull(br, user)
+	plen, _ := br.ReadByte()
+	password := make([]byte, plen)
+	io.ReadFull(br, password)
+	if string(user) != "alice" || string(password) != "secret" {
+		conn.Write([]byte{0x01, 0x01})
+		return "", errors.New("unauthorized")
+	}
+	conn.Write([]byte{0x01, 0x00})
+	req := make([]byte, 4)
+	io.ReadFull(br, req)
+	var host string
+	switch req[3] {
+	case 0x01:
+		ip := make([]byte, 4)
+		io.ReadFull(br, ip)
+		host = net.IP(ip).String()
+	case 0x03:
+		n, _ := br.ReadByte()
+		name := make([]byte, n)
+		io.ReadFull(br, name)
+		host = string(name)
+	}
+	port := make([]byte, 2)
+	io.ReadFull(br, port)
+	conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+func TestClientProxy(t *testing.T) {
+	addr := newTestServer(t, &Server{Handler: echoHandler})
+	httpProxy := serveProxy(t, httpConnectProxy("Basic dXNlcjpwYXNz"))
+	socksProxy := serveProxy(t, socks5Proxy)
+	tests := []struct {
+		url string
+		err bool
+	}{
+		{"http://user:pass@" + httpProxy, false},
+		{"http://user:wrong@" + httpProxy, true},
+		{"socks5://alice:secret@" + socksProxy, false},
+		{"socks5h://alice:wrong@" + socksProxy, true},
+	}
+	for _, tt := range tests {
+		proxy, _ := url.Parse(tt.url)
+		for _, target := range []string{"ws://" + addr, "ws://localhost:" + addr[len("127.0.0.1:"):]} {
+			cli, err := NewClient(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cli.Proxy = func(*url.URL) (*url.URL, error) { return proxy, nil }
+			err = cli.Connect()
+			if tt.err {
+				var cerr *ConnectError
+				if !errors.As(err, &cerr) || cerr.Phase != PhaseProxy {
+					t.Errorf("%s: got %v", tt.url, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", tt.url, err)
+			}
+			if err := cli.Conn.WriteMessage(TextMessage, []byte("via proxy")); err != nil {
+				t.Fatal(err)
+			}
+			_, payload, err := cli.Conn.ReadMessage()
+			if err != nil || string(payload) != "via proxy" {
+				t.Fatalf("%s: got %q %v", tt.url, payload, err)
+			}
+			cli.Close()
+		}
+	}
+}
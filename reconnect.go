@@ -0,0 +1,231 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMinBackoff = 500 * time.Millisecond
+	defaultMaxBackoff = 30 * time.Second
+	defaultQueueSize  = 256
+)
+
+var (
+	ErrQueueFull = errors.New("outbound queue is full")
+)
+
+type queuedMessage struct {
+	opcode  byte
+	payload []byte
+}
+
+// ReconnectingClient keeps a connection to a websocket server open,
+// reconnecting with exponential backoff and jitter whenever it drops.
+// Messages written while disconnected are queued and sent once the next
+// connection is up and OnConnect has returned.
+type ReconnectingClient struct {
+	Client *Client
+
+	// MinBackoff and MaxBackoff bound the delay between attempts. The
+	// delay doubles after every failed attempt or dropped connection and
+	// is randomised over its upper half. They default to 500ms and 30s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// MaxAttempts is the number of consecutive failed attempts after
+	// which Run gives up. Zero retries forever.
+	MaxAttempts int
+
+	// QueueSize is the number of messages buffered while disconnected.
+	// It defaults to 256.
+	QueueSize int
+
+	// OnConnect is called for every new connection before queued
+	// messages are sent, e.g. to resend subscriptions. If it returns an
+	// error the connection is dropped and retried.
+	OnConnect func(*Conn) error
+
+	// OnDisconnect is called with the error that ended a connection.
+	OnDisconnect func(error)
+
+	// OnMessage is called for every data message received.
+	OnMessage func(opcode byte, payload []byte)
+
+	mu    sync.Mutex
+	conn  *Conn
+	queue []queuedMessage
+}
+
+func NewReconnectingClient(url string) (*ReconnectingClient, error) {
+	cli, err := NewClient(url)
+	if err != nil {
+		return nil, err
+	}
+	return &ReconnectingClient{Client: cli}, nil
+}
+
+// backoffBounds returns MinBackoff and MaxBackoff with their defaults.
+func (rc *ReconnectingClient) backoffBounds() (min, max time.Duration) {
+	min, max = rc.MinBackoff, rc.MaxBackoff
+	if min <= 0 {
+		min = defaultMinBackoff
+	}
+	if max <= 0 {
+		max = defaultMaxBackoff
+	}
+	return min, max
+}
+
+// backoff returns the delay before the given attempt, counting from one.
+func (rc *ReconnectingClient) backoff(attempt int) time.Duration {
+	min, max := rc.backoffBounds()
+	d := min
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Run connects and serves the connection until ctx is done, reconnecting
+// whenever it drops. Reconnects back off like failed attempts do, and the
+// delay only starts over once a connection has stayed up for MaxBackoff,
+// so a server that keeps dropping connections is not hammered. Run
+// returns ctx.Err() after closing the connection, or the last connect
+// error once MaxAttempts is exhausted.
+func (rc *ReconnectingClient) Run(ctx context.Context) error {
+	attempt, failures := 0, 0
+	for {
+		err := rc.Client.ConnectContext(ctx)
+		if err == nil && rc.OnConnect != nil {
+			if err = rc.OnConnect(rc.Client.Conn); err != nil {
+				rc.Client.Conn.Close()
+			}
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			failures++
+			if rc.MaxAttempts > 0 && failures >= rc.MaxAttempts {
+				return err
+			}
+		} else {
+			failures = 0
+			start := time.Now()
+			err = rc.serve(ctx, rc.Client.Conn)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if rc.OnDisconnect != nil {
+				rc.OnDisconnect(err)
+			}
+			if _, max := rc.backoffBounds(); time.Since(start) >= max {
+				attempt = 0
+			}
+		}
+		attempt++
+		timer := time.NewTimer(rc.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// serve flushes the queue and reads from conn until it fails or ctx is
+// done.
+func (rc *ReconnectingClient) serve(ctx context.Context, conn *Conn) error {
+	// rc.mu is not held while writing. Messages written meanwhile join
+	// the queue, and conn is only handed to WriteMessage once the queue is
+	// empty, so they stay in order.
+	for {
+		rc.mu.Lock()
+		if len(rc.queue) == 0 {
+			rc.conn = conn
+			rc.mu.Unlock()
+			break
+		}
+		m := rc.queue[0]
+		rc.queue = rc.queue[1:]
+		rc.mu.Unlock()
+		if err := conn.WriteMessage(m.opcode, m.payload); err != nil {
+			rc.mu.Lock()
+			rc.queue = append([]queuedMessage{m}, rc.queue...)
+			rc.conn = conn
+			rc.mu.Unlock()
+			break
+		}
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.CloseWithCode(CloseNormalClosure, "")
+		case <-done:
+		}
+	}()
+	var err error
+	for {
+		var opcode byte
+		var payload []byte
+		opcode, payload, err = conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		if rc.OnMessage != nil {
+			rc.OnMessage(opcode, payload)
+		}
+	}
+	rc.mu.Lock()
+	rc.conn = nil
+	rc.mu.Unlock()
+	conn.Close()
+	return err
+}
+
+// WriteMessage sends a data message on the current connection. While
+// disconnected, or if the write fails, a copy of the message is queued
+// instead.
+func (rc *ReconnectingClient) WriteMessage(opcode byte, payload []byte) error {
+	var failed *Conn
+	for {
+		rc.mu.Lock()
+		conn := rc.conn
+		// Deciding to queue under the same lock as serve's flush means a
+		// queued message is never left behind a connection that is up.
+		if conn == nil || conn == failed {
+			defer rc.mu.Unlock()
+			return rc.enqueue(opcode, payload)
+		}
+		rc.mu.Unlock()
+		if err := conn.WriteMessage(opcode, payload); err == nil {
+			return nil
+		}
+		// Retry in case serve has moved on to a new connection.
+		failed = conn
+	}
+}
+
+// enqueue queues a copy of the message. Called with rc.mu held.
+func (rc *ReconnectingClient) enqueue(opcode byte, payload []byte) error {
+	size := rc.QueueSize
+	if size <= 0 {
+		size = defaultQueueSize
+	}
+	if len(rc.queue) >= size {
+		return ErrQueueFull
+	}
+	rc.queue = append(rc.queue, queuedMessage{opcode: opcode, payload: append([]byte(nil), payload...)})
+	return nil
+}
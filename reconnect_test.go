@@ -0,0 +1,204 @@
+package websocket
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReconnectingClient(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	addr := newTestServer(t, &Server{Handler: func(conn *Conn, r *http.Request) {
+		for {
+			_, payload, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			received = append(received, string(payload))
+			mu.Unlock()
+			if string(payload) == "drop" {
+				// Drop the connection without a close handshake.
+				conn.Conn.Close()
+				return
+			}
+			conn.WriteMessage(TextMessage, payload)
+		}
+	}})
+
+	rc, err := NewReconnectingClient("ws://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.MinBackoff = time.Millisecond
+	rc.MaxBackoff = 10 * time.Millisecond
+	connects := make(chan struct{}, 10)
+	disconnects := make(chan error, 10)
+	messages := make(chan string, 10)
+	rc.OnConnect = func(conn *Conn) error {
+		connects <- struct{}{}
+		return conn.WriteMessage(TextMessage, []byte("subscribe"))
+	}
+	rc.OnDisconnect = func(err error) { disconnects <- err }
+	rc.OnMessage = func(opcode byte, payload []byte) { messages <- string(payload) }
+
+	// Queued before the first connection.
+	if err := rc.WriteMessage(TextMessage, []byte("queued")); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- rc.Run(ctx) }()
+
+	<-connects
+	for _, want := range []string{"subscribe", "queued"} {
+		if got := <-messages; got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+	rc.WriteMessage(TextMessage, []byte("drop"))
+	<-disconnects
+	<-connects
+	if got := <-messages; got != "subscribe" {
+		t.Fatalf("got %q after reconnect", got)
+	}
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Fatalf("Run returned %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"subscribe", "queued", "drop", "subscribe"}
+	if len(received) != len(want) {
+		t.Fatalf("server received %q", received)
+	}
+	for i := range want {
+		if received[i] != want[i] {
+			t.Fatalf("server received %q", received)
+		}
+	}
+}
+
+func TestReconnectingClientMaxAttempts(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	rc, err := NewReconnectingClient("ws://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.MinBackoff = time.Millisecond
+	rc.MaxAttempts = 3
+	var attempts int
+	rc.Client.Dialer = &net.Dialer{Control: func(network, address string, c syscall.RawConn) error {
+		attempts++
+		return nil
+	}}
+	if err := rc.Run(context.Background()); err == nil {
+		t.Fatal("expected error")
+	}
+	if attempts != 3 {
+		t.Fatalf("got %d attempts", attempts)
+	}
+}
+
+func TestReconnectingClientBackoff(t *testing.T) {
+	rc := &ReconnectingClient{MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	for attempt, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max *= time.Millisecond
+		d := rc.backoff(attempt + 1)
+		if d < max/2 || d > max {
+			t.Errorf("attempt %d: got %v, want within [%v, %v]", attempt+1, d, max/2, max)
+		}
+	}
+}
+
+func TestReconnectingClientQueueFull(t *testing.T) {
+	rc := &ReconnectingClient{QueueSize: 1}
+	if err := rc.WriteMessage(TextMessage, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.WriteMessage(TextMessage, nil); err != ErrQueueFull {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestReconnectingClientQueueCopies(t *testing.T) {
+	rc := &ReconnectingClient{}
+	buf := []byte("first")
+	rc.WriteMessage(TextMessage, buf)
+	copy(buf, "later")
+	if got := string(rc.queue[0].payload); got != "first" {
+		t.Fatalf("queued payload changed to %q", got)
+	}
+}
+
+func TestReconnectingClientStalledWrite(t *testing.T) {
+	client, server := newTestConnPair()
+	defer server.Close()
+	rc := &ReconnectingClient{}
+	rc.conn = client
+	// Nothing reads from server, so the write stalls.
+	written := make(chan error, 1)
+	go func() { written <- rc.WriteMessage(BinaryMessage, make([]byte, 1<<16)) }()
+	time.Sleep(10 * time.Millisecond)
+
+	// serve must still be able to tear the connection down.
+	locked := make(chan struct{})
+	go func() {
+		rc.mu.Lock()
+		rc.conn = nil
+		rc.mu.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("WriteMessage holds the lock across a stalled write")
+	}
+	client.Close()
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.queue) != 1 {
+		t.Fatalf("%d messages queued after the write failed", len(rc.queue))
+	}
+}
+
+func TestReconnectingClientBacksOffAfterDrops(t *testing.T) {
+	addr := newTestServer(t, &Server{Handler: func(conn *Conn, r *http.Request) {
+		conn.Conn.Close()
+	}})
+	rc, err := NewReconnectingClient("ws://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.MinBackoff = 20 * time.Millisecond
+	rc.MaxBackoff = time.Second
+	var mu sync.Mutex
+	var connects int
+	rc.OnConnect = func(conn *Conn) error {
+		mu.Lock()
+		connects++
+		mu.Unlock()
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	rc.Run(ctx)
+	mu.Lock()
+	defer mu.Unlock()
+	// The delays grow 10-20ms, 20-40ms, 40-80ms, ... so 300ms fits at
+	// most eight connections.
+	if connects < 2 || connects > 8 {
+		t.Fatalf("%d connections in 300ms", connects)
+	}
+}
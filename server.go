@@ -1,76 +1,256 @@
-package main
+package websocket
 
 import (
 	"bufio"
+	"context"
 	"errors"
-	"fmt"
+	"log"
 	"net"
 	"net/http"
-	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrServerClosed = errors.New("server closed")
 )
 
 type Server struct {
+	Upgrader
+
 	Address  string
 	Listener net.Listener
+
+	// Handler is called in its own goroutine for every upgraded
+	// connection. The connection is closed when Handler returns.
+	Handler func(*Conn, *http.Request)
+
+	// ErrorLog receives handshake failures. If nil, the log package's
+	// standard logger is used.
+	ErrorLog *log.Logger
+
+	// ShutdownCode is the close code Shutdown sends to every connection.
+	// It defaults to CloseGoingAway; use CloseServiceRestart to tell
+	// clients the server will be back shortly.
+	ShutdownCode int
+
+	mu       sync.Mutex
+	closing  bool
+	conns    map[net.Conn]*Conn // nil until the handshake completes
+	handlers sync.WaitGroup
 }
 
 func NewServer(address string) (*Server, error) {
 	return &Server{Address: address}, nil
 }
 
+func (srv *Server) logf(format string, args ...interface{}) {
+	if srv.ErrorLog != nil {
+		srv.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
 func (srv *Server) Listen() error {
-	var err error
-	srv.Listener, err = net.Listen("tcp", srv.Address)
+	l, err := net.Listen("tcp", srv.Address)
 	if err != nil {
 		return err
 	}
+	return srv.Serve(l)
+}
+
+// Serve accepts connections on l and upgrades each of them in its own
+// goroutine. A failed handshake only drops that connection, and
+// temporary accept errors are retried with backoff. After Shutdown or
+// Close, Serve returns ErrServerClosed.
+func (srv *Server) Serve(l net.Listener) error {
+	srv.mu.Lock()
+	if srv.closing {
+		srv.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	srv.Listener = l
+	srv.mu.Unlock()
+	var delay time.Duration
 	for {
-		conn, err := srv.Listener.Accept()
-		if err != nil {
-			return err
-		}
-		br := bufio.NewReader(conn)
-		req, err := http.ReadRequest(br)
+		conn, err := l.Accept()
 		if err != nil {
+			if srv.shuttingDown() {
+				return ErrServerClosed
+			}
+			// Back off on temporary errors such as running out of file
+			// descriptors, as net/http does.
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				srv.logf("websocket: accept error: %v; retrying in %v", err, delay)
+				time.Sleep(delay)
+				continue
+			}
 			return err
 		}
-		fmt.Println(req.URL.Path)
-		bw := bufio.NewWriter(conn)
-		if req.Method != "GET" {
-			bw.WriteString("HTTP/1.1 405 Method Not Allowed\r\n")
-			bw.WriteString("\r\n")
-			bw.Flush()
-			return errors.New("bad method")
+		delay = 0
+		if !srv.trackConn(conn, nil) {
+			conn.Close()
+			continue
 		}
-		if strings.ToLower(req.Header.Get("Upgrade")) != "websocket" ||
-			strings.ToLower(req.Header.Get("Connection")) != "upgrade" {
-			bw.WriteString("HTTP/1.1 400 Bad Request\r\n")
-			bw.WriteString("\r\n")
-			bw.Flush()
-			return errors.New("missing or bad upgrade")
-		}
-		if req.Header.Get("Sec-Websocket-Key") == "" {
-			bw.WriteString("HTTP/1.1 400 Bad Request\r\n")
-			bw.WriteString("\r\n")
-			bw.Flush()
-			return errors.New("mismatch challenge/response")
+		go srv.serveConn(conn)
+	}
+}
+
+func (srv *Server) serveConn(conn net.Conn) {
+	defer srv.untrackConn(conn)
+	ws, req, err := srv.handshake(conn)
+	if err != nil {
+		srv.logf("websocket: handshake with %s failed: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	if !srv.trackConn(conn, ws) {
+		ws.CloseWithCode(srv.shutdownCode(), "")
+		return
+	}
+	defer ws.Close()
+	if srv.Handler != nil {
+		srv.Handler(ws, req)
+	}
+}
+
+func (srv *Server) shuttingDown() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.closing
+}
+
+// trackConn registers conn, or records that its handshake produced ws. It
+// reports false once the server is shutting down.
+func (srv *Server) trackConn(conn net.Conn, ws *Conn) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.closing {
+		return false
+	}
+	if srv.conns == nil {
+		srv.conns = make(map[net.Conn]*Conn)
+	}
+	if ws == nil {
+		srv.handlers.Add(1)
+	}
+	srv.conns[conn] = ws
+	return true
+}
+
+func (srv *Server) untrackConn(conn net.Conn) {
+	srv.mu.Lock()
+	delete(srv.conns, conn)
+	srv.mu.Unlock()
+	srv.handlers.Done()
+}
+
+func (srv *Server) shutdownCode() int {
+	if !isSendableCloseCode(srv.ShutdownCode) {
+		return CloseGoingAway
+	}
+	return srv.ShutdownCode
+}
+
+// stop marks the server as closing, closes the listener and returns the
+// connections that are still open.
+func (srv *Server) stop() (map[net.Conn]*Conn, error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.closing = true
+	var err error
+	if srv.Listener != nil {
+		err = srv.Listener.Close()
+	}
+	conns := make(map[net.Conn]*Conn, len(srv.conns))
+	for conn, ws := range srv.conns {
+		conns[conn] = ws
+	}
+	return conns, err
+}
+
+func closeConns(conns map[net.Conn]*Conn) {
+	for conn, ws := range conns {
+		if ws != nil {
+			ws.Close()
+		} else {
+			conn.Close()
 		}
-		if req.Header.Get("Sec-WebSocket-Version") != "13" {
-			bw.WriteString("HTTP/1.1 400 Bad Request\r\n")
-			bw.WriteString("Sec-WebSocket-Version: 13\r\n")
-			bw.WriteString("\r\n")
-			bw.Flush()
-			return errors.New("missing or bad WebSocket Version")
+	}
+}
+
+// Shutdown stops accepting connections and sends ShutdownCode to every
+// open connection, then waits for the handlers to return. Connections
+// still in their handshake are closed the same way once it completes. If
+// ctx expires first, the remaining connections are closed and ctx's error
+// is returned.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	conns, err := srv.stop()
+	code := srv.shutdownCode()
+	for _, ws := range conns {
+		if ws != nil {
+			go ws.CloseWithCode(code, "")
 		}
-		accept, err := genNonceAccept(req.Header.Get("Sec-Websocket-Key"))
-		if err != nil {
-			return err
+	}
+	done := make(chan struct{})
+	go func() {
+		srv.handlers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		conns, _ = srv.stop()
+		closeConns(conns)
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting connections and closes every open connection
+// without a close handshake.
+func (srv *Server) Close() error {
+	conns, err := srv.stop()
+	closeConns(conns)
+	return err
+}
+
+// handshake reads the upgrade request and answers it. The request must
+// arrive within ReadTimeout, or IdleTimeout if that is longer.
+func (srv *Server) handshake(conn net.Conn) (*Conn, *http.Request, error) {
+	timeout := srv.ReadTimeout
+	if srv.IdleTimeout > timeout {
+		timeout = srv.IdleTimeout
+	}
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+	header, err := srv.Upgrader.handshake(req, nil)
+	if err != nil {
+		if herr, ok := err.(*HandshakeError); ok {
+			writeResponse(conn, herr.Status, herr.Header)
 		}
-		bw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
-		bw.WriteString("Upgrade: websocket\r\n")
-		bw.WriteString("Connection: Upgrade\r\n")
-		bw.WriteString("Sec-WebSocket-Accept: " + accept + "\r\n")
-		bw.Flush()
-		conn.Close()
+		return nil, nil, err
+	}
+	if srv.WriteTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(srv.WriteTimeout))
+	}
+	if err := writeResponse(conn, http.StatusSwitchingProtocols, header); err != nil {
+		return nil, nil, err
 	}
+	conn.SetWriteDeadline(time.Time{})
+	return srv.Upgrader.newConn(conn, br, header), req, nil
 }
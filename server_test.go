@@ -1,14 +1,302 @@
-package main
+package websocket
 
-import "testing"
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
 
 func TestServer(t *testing.T) {
-	server, err := NewServer("127.0.0.1:8000")
+	server, err := NewServer("127.0.0.1:0")
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = server.Listen()
+	l, err := net.Listen("tcp", server.Address)
 	if err != nil {
 		t.Fatal(err)
 	}
+	errs := make(chan error, 1)
+	go func() { errs <- server.Serve(l) }()
+	l.Close()
+	if err := <-errs; err == nil {
+		t.Fatal("Serve returned nil after its listener was closed")
+	}
+}
+
+// flakyListener fails its first accepts with a temporary error.
+type flakyListener struct {
+	net.Listener
+	failures int
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures > 0 {
+		l.failures--
+		return nil, temporaryError{}
+	}
+	return l.Listener.Accept()
+}
+
+func TestServerRetriesTemporaryAcceptErrors(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{Handler: echoHandler, ErrorLog: log.New(io.Discard, "", 0)}
+	errs := make(chan error, 1)
+	go func() { errs <- server.Serve(&flakyListener{Listener: l, failures: 3}) }()
+	defer server.Close()
+	cli := dialTestServer(t, l.Addr().String())
+	if err := cli.Conn.WriteMessage(TextMessage, hello()); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := cli.Conn.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errs:
+		t.Fatalf("Serve returned %v", err)
+	default:
+	}
+}
+
+// newTestServer serves server on a local port and returns its address.
+func newTestServer(t *testing.T, server *Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.ErrorLog == nil {
+		server.ErrorLog = log.New(io.Discard, "", 0)
+	}
+	go server.Serve(l)
+	t.Cleanup(func() { l.Close() })
+	return l.Addr().String()
+}
+
+func echoHandler(conn *Conn, req *http.Request) {
+	for {
+		opcode, payload, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if err := conn.WriteMessage(opcode, payload); err != nil {
+			return
+		}
+	}
+}
+
+func TestServerHandler(t *testing.T) {
+	addr := newTestServer(t, &Server{Handler: echoHandler})
+
+	// A bad handshake must not stop the accept loop.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("POST /ws HTTP/1.1\r\nHost: " + addr + "\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	conn.Close()
+
+	cli, err := NewClient("ws://" + addr + "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.Conn.WriteMessage(TextMessage, []byte("hello world!")); err != nil {
+		t.Fatal(err)
+	}
+	opcode, payload, err := cli.Conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opcode != TextMessage || string(payload) != "hello world!" {
+		t.Fatalf("got %d %q", opcode, payload)
+	}
+}
+
+func TestServerHandshakeTimeout(t *testing.T) {
+	server := &Server{Handler: echoHandler}
+	server.ReadTimeout = 50 * time.Millisecond
+	addr := newTestServer(t, server)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET /ws HTTP/1.1\r\n"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("got %v, want the server to hang up", err)
+	}
+}
+
+// pipelinedUpgrade writes an upgrade request and a masked "Hello" text
+// frame to conn in a single write, then reads the response.
+func pipelinedUpgrade(conn net.Conn) {
+	var buf bytes.Buffer
+	buf.WriteString("GET /ws HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	writeFrame(&buf, &Frame{FIN: true, OpCode: TextMessage, Length: 5, Mask: true, MaskingKey: [4]byte{1, 2, 3, 4}, Payload: hello()})
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return
+	}
+	http.ReadResponse(bufio.NewReader(conn), nil)
+}
+
+func TestServerKeepsPipelinedFrame(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go pipelinedUpgrade(c1)
+	conn, _, err := (&Server{}).handshake(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	opcode, payload, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opcode != TextMessage || string(payload) != "Hello" {
+		t.Fatalf("got %d %q", opcode, payload)
+	}
+}
+
+// serveTestServer is newTestServer for tests that need Serve's result.
+func serveTestServer(t *testing.T, server *Server) (string, chan error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.ErrorLog = log.New(io.Discard, "", 0)
+	errs := make(chan error, 1)
+	go func() { errs <- server.Serve(l) }()
+	t.Cleanup(func() { server.Close() })
+	return l.Addr().String(), errs
+}
+
+func dialTestServer(t *testing.T, addr string) *Client {
+	cli, err := NewClient("ws://" + addr + "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cli.Close() })
+	return cli
+}
+
+func TestServerShutdown(t *testing.T) {
+	returned := make(chan struct{})
+	server := &Server{Handler: func(conn *Conn, r *http.Request) {
+		echoHandler(conn, r)
+		close(returned)
+	}}
+	server.ShutdownCode = CloseServiceRestart
+	addr, errs := serveTestServer(t, server)
+	cli := dialTestServer(t, addr)
+	if err := cli.Conn.WriteMessage(TextMessage, hello()); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := cli.Conn.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- server.Shutdown(ctx)
+	}()
+	_, _, err := cli.Conn.ReadMessage()
+	if cerr, ok := err.(*CloseError); !ok || cerr.Code != CloseServiceRestart {
+		t.Fatalf("got %v, want close %d", err, CloseServiceRestart)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-returned:
+	default:
+		t.Fatal("Shutdown returned before the handler")
+	}
+	if err := <-errs; err != ErrServerClosed {
+		t.Fatalf("Serve returned %v", err)
+	}
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Fatal("server still accepting after Shutdown")
+	}
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	server := &Server{Handler: func(conn *Conn, r *http.Request) {
+		<-release
+	}}
+	addr, errs := serveTestServer(t, server)
+	cli := dialTestServer(t, addr)
+
+	// The client never answers the close frame, so the handler is still
+	// running when the context expires.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown returned %v", err)
+	}
+	if err := <-errs; err != ErrServerClosed {
+		t.Fatalf("Serve returned %v", err)
+	}
+	_, _, err := cli.Conn.ReadMessage()
+	if cerr, ok := err.(*CloseError); !ok || cerr.Code != CloseGoingAway {
+		t.Fatalf("got %v, want close %d", err, CloseGoingAway)
+	}
+	cli.Conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := cli.Conn.Conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("got %v, want the connection closed", err)
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	server := &Server{Handler: echoHandler}
+	addr, errs := serveTestServer(t, server)
+	cli := dialTestServer(t, addr)
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != ErrServerClosed {
+		t.Fatalf("Serve returned %v", err)
+	}
+	_, _, err := cli.Conn.ReadMessage()
+	if cerr, ok := err.(*CloseError); !ok || cerr.Code != CloseAbnormalClosure {
+		t.Fatalf("got %v, want close %d", err, CloseAbnormalClosure)
+	}
+	server.Address = "127.0.0.1:0"
+	if err := server.Listen(); err != ErrServerClosed {
+		t.Fatalf("Listen after Close returned %v", err)
+	}
 }
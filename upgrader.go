@@ -0,0 +1,241 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotHijacker = errors.New("response does not implement http.Hijacker")
+)
+
+// HandshakeError is returned when an upgrade request is rejected. Status
+// is the HTTP status code sent back to the client.
+type HandshakeError struct {
+	Status int
+	Header http.Header
+	Text   string
+}
+
+func (e *HandshakeError) Error() string {
+	return e.Text
+}
+
+// Upgrader upgrades HTTP requests to websocket connections. It can be
+// used from any http.Handler whose ResponseWriter implements
+// http.Hijacker.
+type Upgrader struct {
+	// PingInterval enables a keepalive loop that pings the peer at this
+	// interval. PongTimeout is how long to wait for the answering pong
+	// before the connection is closed; zero disables the check.
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+
+	// IdleTimeout bounds the wait for the next frame from the peer, and
+	// ReadTimeout the time to receive a frame once it has started, so a
+	// peer trickling bytes is dropped. WriteTimeout bounds sending each
+	// frame. Expiry is reported as ErrIdleTimeout, ErrReadTimeout or
+	// ErrWriteTimeout. Zero means no timeout.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+
+	// MaxFrameSize and MaxMessageSize limit the payload of a single frame
+	// and of a reassembled message read from the peer, see
+	// Conn.SetFrameLimit and Conn.SetReadLimit. Zero means no limit.
+	MaxFrameSize   int64
+	MaxMessageSize int64
+
+	// SkipUTF8Validation stops text messages and close reasons from being
+	// checked for valid UTF-8. Only set it for trusted peers.
+	SkipUTF8Validation bool
+
+	// EnableCompression accepts the permessage-deflate extension (RFC
+	// 7692) when the client offers it.
+	EnableCompression bool
+
+	// Subprotocols lists the supported subprotocols in order of
+	// preference. The first one also offered by the client is selected,
+	// unless the response header passed to Upgrade already sets
+	// Sec-WebSocket-Protocol.
+	Subprotocols []string
+
+	// CheckOrigin reports whether the request's Origin may open a
+	// connection; a rejected request is answered with 403 Forbidden. If
+	// nil, CheckSameOrigin is used, so that web pages on other sites
+	// cannot connect with the user's cookies. See also AllowOrigins.
+	CheckOrigin func(r *http.Request) bool
+}
+
+// selectSubprotocol returns the first of the server's subprotocols that
+// the client offered, or "" if there is none.
+func (u *Upgrader) selectSubprotocol(req *http.Request) string {
+	offered := subprotocols(req.Header)
+	for _, p := range u.Subprotocols {
+		for _, o := range offered {
+			if p == o {
+				return p
+			}
+		}
+	}
+	return ""
+}
+
+// subprotocols returns the values of the Sec-WebSocket-Protocol header.
+func subprotocols(header http.Header) []string {
+	return headerTokens(header, "Sec-WebSocket-Protocol")
+}
+
+// headerTokens returns the comma separated tokens of every name header,
+// as in "Connection: keep-alive, Upgrade".
+func headerTokens(header http.Header, name string) []string {
+	var tokens []string
+	for _, line := range header.Values(name) {
+		for _, t := range strings.Split(line, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				tokens = append(tokens, t)
+			}
+		}
+	}
+	return tokens
+}
+
+// hasToken reports whether the name header lists token, ignoring case.
+func hasToken(header http.Header, name, token string) bool {
+	for _, t := range headerTokens(header, name) {
+		if strings.EqualFold(t, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// newConn wraps an upgraded connection; header is the 101 response that
+// was sent.
+func (u *Upgrader) newConn(conn net.Conn, br *bufio.Reader, header http.Header) *Conn {
+	c := newConn(conn, br, true)
+	c.subprotocol = header.Get("Sec-WebSocket-Protocol")
+	params, _ := parseDeflateResponse(header)
+	c.enableDeflate(params)
+	c.setTimeouts(u.ReadTimeout, u.WriteTimeout, u.IdleTimeout)
+	c.SetFrameLimit(u.MaxFrameSize)
+	c.SetReadLimit(u.MaxMessageSize)
+	c.skipUTF8 = u.SkipUTF8Validation
+	c.startKeepalive(u.PingInterval, u.PongTimeout)
+	return c
+}
+
+// validKey reports whether key is the base64 encoding of 16 bytes.
+func validKey(key string) bool {
+	b, err := base64.StdEncoding.DecodeString(key)
+	return err == nil && len(b) == 16
+}
+
+// handshake validates req and returns the headers of the 101 response.
+func (u *Upgrader) handshake(req *http.Request, responseHeader http.Header) (http.Header, error) {
+	if req.Method != "GET" {
+		return nil, &HandshakeError{
+			Status: http.StatusMethodNotAllowed,
+			Header: http.Header{"Allow": {"GET"}},
+			Text:   "bad method",
+		}
+	}
+	if !req.ProtoAtLeast(1, 1) {
+		return nil, &HandshakeError{Status: http.StatusBadRequest, Text: "bad HTTP version"}
+	}
+	if req.Host == "" {
+		return nil, &HandshakeError{Status: http.StatusBadRequest, Text: "missing host"}
+	}
+	if !hasToken(req.Header, "Upgrade", "websocket") || !hasToken(req.Header, "Connection", "upgrade") {
+		return nil, &HandshakeError{Status: http.StatusBadRequest, Text: "missing or bad upgrade"}
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, &HandshakeError{
+			Status: http.StatusUpgradeRequired,
+			Header: http.Header{"Sec-Websocket-Version": {"13"}},
+			Text:   "missing or bad WebSocket Version",
+		}
+	}
+	if !validKey(req.Header.Get("Sec-WebSocket-Key")) {
+		return nil, &HandshakeError{Status: http.StatusBadRequest, Text: "missing or bad Sec-WebSocket-Key"}
+	}
+	checkOrigin := u.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = CheckSameOrigin
+	}
+	if !checkOrigin(req) {
+		return nil, &HandshakeError{Status: http.StatusForbidden, Text: "origin not allowed"}
+	}
+	accept, err := genNonceAccept(req.Header.Get("Sec-Websocket-Key"))
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{}
+	for k, v := range responseHeader {
+		header[k] = v
+	}
+	header.Set("Upgrade", "websocket")
+	header.Set("Connection", "Upgrade")
+	header.Set("Sec-WebSocket-Accept", accept)
+	if header.Get("Sec-WebSocket-Protocol") == "" {
+		header.Del("Sec-WebSocket-Protocol")
+		if p := u.selectSubprotocol(req); p != "" {
+			header.Set("Sec-WebSocket-Protocol", p)
+		}
+	}
+	header.Del("Sec-WebSocket-Extensions")
+	if u.EnableCompression {
+		if ext, ok := negotiateDeflate(req.Header); ok {
+			header.Set("Sec-WebSocket-Extensions", ext)
+		}
+	}
+	return header, nil
+}
+
+// writeResponse writes a bare HTTP/1.1 response head to w.
+func writeResponse(w io.Writer, status int, header http.Header) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("HTTP/1.1 " + strconv.Itoa(status) + " " + http.StatusText(status) + "\r\n")
+	header.Write(bw)
+	bw.WriteString("\r\n")
+	return bw.Flush()
+}
+
+// Upgrade upgrades the HTTP connection behind w to the websocket
+// protocol. responseHeader is added to the 101 response. On failure an
+// HTTP error response has already been written.
+func (u *Upgrader) Upgrade(w http.ResponseWriter, r *http.Request, responseHeader http.Header) (*Conn, error) {
+	header, err := u.handshake(r, responseHeader)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if herr, ok := err.(*HandshakeError); ok {
+			status = herr.Status
+			for k, v := range herr.Header {
+				w.Header()[k] = v
+			}
+		}
+		http.Error(w, http.StatusText(status), status)
+		return nil, err
+	}
+	h, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil, ErrNotHijacker
+	}
+	conn, brw, err := h.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeResponse(conn, http.StatusSwitchingProtocols, header); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return u.newConn(conn, brw.Reader, header), nil
+}
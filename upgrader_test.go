@@ -0,0 +1,225 @@
+package websocket
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUpgrader(t *testing.T) {
+	var upgrader Upgrader
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, http.Header{"X-Test": {"1"}})
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		echoHandler(conn, r)
+	}))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+
+	cli, err := NewClient("ws" + ts.URL[len("http"):] + "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if cli.Response.Header.Get("X-Test") != "1" {
+		t.Fatalf("missing response header: %v", cli.Response.Header)
+	}
+	if err := cli.Conn.WriteMessage(BinaryMessage, []byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	opcode, payload, err := cli.Conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opcode != BinaryMessage || string(payload) != "\x01\x02\x03" {
+		t.Fatalf("got %d %v", opcode, payload)
+	}
+}
+
+func TestUpgraderVersion(t *testing.T) {
+	var upgrader Upgrader
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	r.Header.Set("Sec-WebSocket-Version", "8")
+	if _, err := upgrader.Upgrade(w, r, nil); err == nil {
+		t.Fatal("expected error")
+	}
+	if w.Code != http.StatusUpgradeRequired || w.Header().Get("Sec-WebSocket-Version") != "13" {
+		t.Fatalf("got %d %v", w.Code, w.Header())
+	}
+}
+
+func TestUpgraderHandshakeChecks(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(r *http.Request)
+		status int
+	}{
+		{"valid", func(r *http.Request) {}, http.StatusSwitchingProtocols},
+		{"connection token list", func(r *http.Request) { r.Header.Set("Connection", "keep-alive, Upgrade") }, http.StatusSwitchingProtocols},
+		{"mixed case tokens", func(r *http.Request) { r.Header.Set("Upgrade", "WebSocket") }, http.StatusSwitchingProtocols},
+		{"post", func(r *http.Request) { r.Method = "POST" }, http.StatusMethodNotAllowed},
+		{"http/1.0", func(r *http.Request) { r.Proto, r.ProtoMajor, r.ProtoMinor = "HTTP/1.0", 1, 0 }, http.StatusBadRequest},
+		{"no host", func(r *http.Request) { r.Host = "" }, http.StatusBadRequest},
+		{"no upgrade", func(r *http.Request) { r.Header.Del("Upgrade") }, http.StatusBadRequest},
+		{"connection without upgrade", func(r *http.Request) { r.Header.Set("Connection", "keep-alive") }, http.StatusBadRequest},
+		{"upgrade as substring", func(r *http.Request) { r.Header.Set("Connection", "upgraded") }, http.StatusBadRequest},
+		{"no key", func(r *http.Request) { r.Header.Del("Sec-WebSocket-Key") }, http.StatusBadRequest},
+		{"short key", func(r *http.Request) { r.Header.Set("Sec-WebSocket-Key", "c2hvcnQ=") }, http.StatusBadRequest},
+		{"key not base64", func(r *http.Request) { r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ") }, http.StatusBadRequest},
+		{"no version", func(r *http.Request) { r.Header.Del("Sec-WebSocket-Version") }, http.StatusUpgradeRequired},
+		{"same origin", func(r *http.Request) { r.Header.Set("Origin", "http://"+r.Host) }, http.StatusSwitchingProtocols},
+		{"cross origin", func(r *http.Request) { r.Header.Set("Origin", "https://evil.com") }, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Upgrade", "websocket")
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		r.Header.Set("Sec-WebSocket-Version", "13")
+		tt.modify(r)
+		var u Upgrader
+		status := http.StatusSwitchingProtocols
+		_, err := u.handshake(r, nil)
+		if herr, ok := err.(*HandshakeError); ok {
+			status = herr.Status
+			if status == http.StatusMethodNotAllowed && herr.Header.Get("Allow") != "GET" {
+				t.Errorf("%s: missing Allow header", tt.name)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if status != tt.status {
+			t.Errorf("%s: got status %d, want %d", tt.name, status, tt.status)
+		}
+	}
+}
+
+func TestUpgraderSubprotocol(t *testing.T) {
+	server := &Server{Handler: func(conn *Conn, r *http.Request) {
+		conn.WriteMessage(TextMessage, []byte(conn.Subprotocol()))
+		conn.ReadMessage()
+	}}
+	server.Subprotocols = []string{"mqtt", "graphql-transport-ws"}
+	addr := newTestServer(t, server)
+	tests := []struct {
+		offered []string
+		want    string
+	}{
+		{[]string{"graphql-transport-ws", "mqtt"}, "mqtt"},
+		{[]string{"graphql-transport-ws"}, "graphql-transport-ws"},
+		{[]string{"stomp"}, ""},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		cli, err := NewClient("ws://" + addr + "/ws")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cli.Subprotocols = tt.offered
+		if err := cli.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		_, payload, err := cli.Conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cli.Conn.Subprotocol() != tt.want || string(payload) != tt.want {
+			t.Errorf("%v: got %q, server %q, want %q", tt.offered, cli.Conn.Subprotocol(), payload, tt.want)
+		}
+		cli.Close()
+	}
+}
+
+func TestClientRejectsUnofferedSubprotocol(t *testing.T) {
+	var upgrader Upgrader
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, http.Header{"Sec-Websocket-Protocol": {"stomp"}})
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer ts.Close()
+	cli, err := NewClient("ws" + ts.URL[len("http"):] + "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.Subprotocols = []string{"mqtt"}
+	if err := cli.Connect(); err != ErrBadSubprotocol {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestUpgraderKeepsPipelinedFrame(t *testing.T) {
+	var upgrader Upgrader
+	got := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			got <- err.Error()
+			return
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, payload, err := conn.ReadMessage()
+		if err != nil {
+			got <- err.Error()
+			return
+		}
+		got <- string(payload)
+	}))
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	pipelinedUpgrade(conn)
+	if s := <-got; s != "Hello" {
+		t.Fatalf("got %q", s)
+	}
+}
+
+func TestUpgraderCheckOrigin(t *testing.T) {
+	server := &Server{Handler: echoHandler}
+	server.CheckOrigin = AllowOrigins("https://app.example.com")
+	addr := newTestServer(t, server)
+
+	cli, err := NewClient("ws://" + addr + "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Connect(); err == nil {
+		cli.Close()
+		t.Fatal("connected from an origin that is not allowed")
+	}
+	if cli.Response == nil || cli.Response.StatusCode != http.StatusForbidden {
+		t.Fatalf("got response %v", cli.Response)
+	}
+
+	cli.Header.Set("Origin", "https://app.example.com")
+	if err := cli.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	cli.Close()
+}
@@ -0,0 +1,66 @@
+package websocket
+
+import (
+	"errors"
+	"unicode/utf8"
+)
+
+var (
+	ErrInvalidUTF8 = errors.New("invalid UTF-8 in text message")
+)
+
+// utf8Validator validates text that arrives in arbitrary pieces. A rune
+// split between pieces is held back until it is complete, while bytes
+// that can no longer start a valid rune fail immediately.
+type utf8Validator struct {
+	p [utf8.UTFMax]byte
+	n int
+}
+
+func (v *utf8Validator) reset() {
+	v.n = 0
+}
+
+// write reports whether p is valid as a continuation of the text so far.
+func (v *utf8Validator) write(p []byte) bool {
+	for v.n > 0 && len(p) > 0 {
+		v.p[v.n] = p[0]
+		v.n++
+		p = p[1:]
+		if utf8.FullRune(v.p[:v.n]) {
+			if r, size := utf8.DecodeRune(v.p[:v.n]); r == utf8.RuneError && size == 1 {
+				return false
+			}
+			v.n = 0
+		}
+	}
+	// Hold back a trailing rune that is incomplete but still valid.
+	for i := len(p) - 1; i >= 0 && i >= len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if !utf8.FullRune(p[i:]) {
+				v.n = copy(v.p[:], p[i:])
+				p = p[:i]
+			}
+			break
+		}
+	}
+	return utf8.Valid(p)
+}
+
+// complete reports whether the text does not end inside a rune.
+func (v *utf8Validator) complete() bool {
+	return v.n == 0
+}
+
+// checkUTF8 validates p, the next piece of the message being read, if it
+// is a text message. end marks the end of the message. Invalid text fails
+// the connection with CloseInvalidFramePayloadData.
+func (c *Conn) checkUTF8(p []byte, end bool) error {
+	if !c.readText {
+		return nil
+	}
+	if !c.readUTF8.write(p) || end && !c.readUTF8.complete() {
+		return c.failRead(CloseInvalidFramePayloadData, ErrInvalidUTF8)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package websocket
+
+import (
+	"bytes"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestUTF8Validator(t *testing.T) {
+	tests := []struct {
+		text  string
+		valid bool
+	}{
+		{"", true},
+		{"hello", true},
+		{"κόσμε", true},
+		{"\xf0\x9f\x98\x80 emoji", true},
+		{"\xe2\x82", false},
+		{"\xed\xa0\x80", false},
+		{"\xf4\x90\x80\x80", false},
+		{"\xc0\xaf", false},
+		{"ab\xff", false},
+		{"\x80", false},
+	}
+	for _, tt := range tests {
+		// Every split into two pieces must agree with utf8.Valid.
+		for i := 0; i <= len(tt.text); i++ {
+			var v utf8Validator
+			got := v.write([]byte(tt.text[:i])) && v.write([]byte(tt.text[i:])) && v.complete()
+			if got != tt.valid {
+				t.Errorf("%q split at %d: got %v, want %v", tt.text, i, got, tt.valid)
+			}
+		}
+	}
+}
+
+func TestUTF8ValidatorFailsFast(t *testing.T) {
+	var v utf8Validator
+	// A surrogate is known to be invalid from its first two bytes.
+	if v.write([]byte("ok\xed\xa0")) {
+		t.Fatal("surrogate prefix accepted")
+	}
+	v.reset()
+	if !v.write([]byte("ok\xf0\x9f")) || v.complete() {
+		t.Fatal("valid prefix rejected or reported complete")
+	}
+}
+
+func TestConnInvalidUTF8(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames []*Frame
+	}{
+		{"single frame", []*Frame{{FIN: true, OpCode: TextMessage, Payload: []byte("a\xffb")}}},
+		{"truncated rune", []*Frame{{FIN: true, OpCode: TextMessage, Payload: []byte("a\xe2\x82")}}},
+		{"split rune", []*Frame{
+			{OpCode: TextMessage, Payload: []byte("a\xe2")},
+			{FIN: true, OpCode: ContinuationMessage, Payload: []byte("\x82")},
+		}},
+		{"close reason", []*Frame{{FIN: true, OpCode: CloseMessage, Payload: []byte{0x03, 0xe8, 0xff}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := newTestConnPair()
+			defer client.Close()
+			defer server.Close()
+			writeTestFrames(server.Conn, tt.frames...)
+			code := readCloseCode(server)
+			if _, _, err := client.ReadMessage(); err != ErrInvalidUTF8 {
+				t.Fatalf("got %v, want %v", err, ErrInvalidUTF8)
+			}
+			if c := <-code; c != CloseInvalidFramePayloadData {
+				t.Fatalf("got close code %d, want %d", c, CloseInvalidFramePayloadData)
+			}
+		})
+	}
+}
+
+func TestConnUTF8AcrossFragments(t *testing.T) {
+	client, server := newTestConnPair()
+	defer client.Close()
+	defer server.Close()
+	text := []byte("héllo wörld \xf0\x9f\x98\x80")
+	var frames []*Frame
+	for i, b := range text {
+		opcode := ContinuationMessage
+		if i == 0 {
+			opcode = TextMessage
+		}
+		frames = append(frames, &Frame{FIN: i == len(text)-1, OpCode: opcode, Payload: []byte{b}})
+	}
+	writeTestFrames(server.Conn, frames...)
+	_, got, err := client.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, text) || !utf8.Valid(got) {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestConnInvalidUTF8FailsMidMessage(t *testing.T) {
+	client, server := newTestConnPair()
+	defer client.Close()
+	defer server.Close()
+	// The final frame never arrives; the bad first fragment must be enough.
+	writeTestFrames(server.Conn, &Frame{OpCode: TextMessage, Payload: []byte("ok\xff")})
+	code := readCloseCode(server)
+	if _, _, err := client.ReadMessage(); err != ErrInvalidUTF8 {
+		t.Fatalf("got %v, want %v", err, ErrInvalidUTF8)
+	}
+	<-code
+}
+
+func TestConnSkipUTF8(t *testing.T) {
+	client, server := newTestConnPair()
+	defer client.Close()
+	defer server.Close()
+	client.skipUTF8 = true
+	writeTestFrames(server.Conn, &Frame{FIN: true, OpCode: TextMessage, Payload: []byte("\xff")})
+	if _, got, err := client.ReadMessage(); err != nil || string(got) != "\xff" {
+		t.Fatalf("got %q %v", got, err)
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package websocket
 
 import (
 	"crypto/rand"
@@ -7,7 +7,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
-	"net"
+	"math"
 )
 
 var (
@@ -17,34 +17,28 @@ var (
 var (
 	ErrShortBuffer      = errors.New("short buffer")
 	ErrNotSupportFinRsv = errors.New("not support fin or rsv")
+	ErrBadLength        = errors.New("most significant bit of 64-bit payload length set")
+	ErrFrameTooBig      = errors.New("frame exceeds read limit")
+	ErrNonMinimalLength = errors.New("payload length not minimally encoded")
 )
 
 var (
-	TextMessage   byte = 0x01
-	BinaryMessage byte = 0x02
-	CloseMessage  byte = 0x08
-	PingMessage   byte = 0x09
-	PongMessage   byte = 0x0a
+	ContinuationMessage byte = 0x00
+	TextMessage         byte = 0x01
+	BinaryMessage       byte = 0x02
+	CloseMessage        byte = 0x08
+	PingMessage         byte = 0x09
+	PongMessage         byte = 0x0a
 )
 
 func genNonce() (string, error) {
 	p := make([]byte, 16)
-	n, err := rand.Reader.Read(p)
-	if n != 16 {
-		return "", ErrShortBuffer
-	}
-	if err != nil {
+	if _, err := io.ReadFull(rand.Reader, p); err != nil {
 		return "", err
 	}
 	return base64.StdEncoding.EncodeToString(p), nil
 }
 
-func genMaskKey() ([4]byte, error) {
-	var p [4]byte
-	_, err := io.ReadFull(rand.Reader, p[:])
-	return p, err
-}
-
 func genNonceAccept(nonce string) (string, error) {
 	h := sha1.New()
 	if _, err := h.Write([]byte(nonce)); err != nil {
@@ -58,23 +52,6 @@ func genNonceAccept(nonce string) (string, error) {
 	return string(expected), nil
 }
 
-func readByte(rd io.Reader) (byte, error) {
-	var b = make([]byte, 1)
-	n, err := rd.Read(b)
-	if n != 1 {
-		return 0, ErrShortBuffer
-	}
-	return b[0], err
-}
-
-func readBytes(rd io.Reader, p []byte) error {
-	n, err := rd.Read(p)
-	if n != len(p) {
-		return ErrShortBuffer
-	}
-	return err
-}
-
 // 0                   1                   2                   3
 // 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
 // +-+-+-+-+-------+-+-------------+-------------------------------+
@@ -102,173 +79,129 @@ type Frame struct {
 	Mask       bool
 	MaskingKey [4]byte
 	Payload    []byte
-	NextFrame  *Frame
 }
 
-func defaultFrame(opcode byte, payload []byte) (*Frame, error) {
-	key, err := genMaskKey()
-	if err == nil {
-		return nil, err
-	}
-	return &Frame{
-		FIN:        true,
-		RSV:        [3]bool{false, false, false},
-		OpCode:     opcode,
-		Mask:       true,
-		Length:     len(payload),
-		MaskingKey: key,
-		Payload:    payload,
-	}, nil
+func isControl(opcode byte) bool {
+	return opcode&0x08 == 0x08
 }
 
-func writeFrame(wr io.Writer, frame *Frame) error {
-	var length = 2
-	var i = 0
-	switch {
-	case frame.Length < 125:
-		length += 0
-	case frame.Length < 65536:
-		length += 2
-	default:
-		length += 8
-	}
-	if frame.Mask {
-		length += 4
+// maskBytes masks b with key, starting at position pos of the key, and
+// returns the position to continue from. Once pos is aligned it works on
+// eight bytes at a time.
+func maskBytes(key [4]byte, pos int, b []byte) int {
+	i := 0
+	for ; i < len(b) && pos&3 != 0; i++ {
+		b[i] ^= key[pos&3]
+		pos++
+	}
+	if len(b)-i >= 8 {
+		k := uint64(binary.LittleEndian.Uint32(key[:]))
+		k |= k << 32
+		for ; len(b)-i >= 8; i += 8 {
+			binary.LittleEndian.PutUint64(b[i:], binary.LittleEndian.Uint64(b[i:])^k)
+		}
 	}
-	if frame.OpCode == PingMessage || frame.OpCode == PongMessage {
-		length += 1
-	} else {
-		length += frame.Length
+	for ; i < len(b); i++ {
+		b[i] ^= key[pos&3]
+		pos++
 	}
-	var buf = make([]byte, length, length)
-	// 0X80 -> FIN 1 RSV1 0 RSV2 0 RSV3 0
-	frame.OpCode &= 0x0f
+	return pos & 3
+}
+
+// maxHeaderSize is the size of the longest frame header: two bytes, a
+// 64-bit extended length and a masking key.
+const maxHeaderSize = 14
+
+// encodeFrameHeader writes the header of frame to b, which must hold
+// maxHeaderSize bytes, and returns its length.
+func encodeFrameHeader(b []byte, frame *Frame) int {
+	b[0] = frame.OpCode & 0x0f
 	if frame.FIN {
-		buf[i] = 0x80 | frame.OpCode
-	} else {
-		buf[i] = frame.OpCode
+		b[0] |= 0x80
+	}
+	if frame.RSV[0] {
+		b[0] |= 0x40
+	}
+	if frame.RSV[1] {
+		b[0] |= 0x20
 	}
-	if frame.OpCode == PingMessage || frame.OpCode == PongMessage {
-		return nil
+	if frame.RSV[2] {
+		b[0] |= 0x10
 	}
-	i++ // 1
+	b[1] = 0
 	if frame.Mask {
-		buf[i] = 0x80
+		b[1] = 0x80
 	}
+	n := 2
 	switch {
-	case frame.Length < 125:
-		buf[i] |= byte(frame.Length)
-		i++
+	case frame.Length <= 125:
+		b[1] |= byte(frame.Length)
 	case frame.Length < 65536:
-		buf[i] |= 0b01111110
-		binary.BigEndian.PutUint16(buf[2:4], uint16(frame.Length))
-		i += 3
+		b[1] |= 126
+		binary.BigEndian.PutUint16(b[2:4], uint16(frame.Length))
+		n += 2
 	default:
-		buf[i] |= 0b01111111
-		binary.BigEndian.PutUint16(buf[2:10], uint16(frame.Length))
-		i += 9
+		b[1] |= 127
+		binary.BigEndian.PutUint64(b[2:10], uint64(frame.Length))
+		n += 8
 	}
 	if frame.Mask {
-		copy(buf[i:i+4], frame.MaskingKey[:])
-		i += 4
-	}
-	for j := range frame.Payload {
-		buf[i+j] = frame.Payload[j] ^ frame.MaskingKey[j%4]
-	}
-	n, err := wr.Write(buf)
-	if n != length {
-		return ErrNotSupportFinRsv
+		n += copy(b[n:n+4], frame.MaskingKey[:])
 	}
-	if !frame.FIN && frame.NextFrame != nil {
-		err := writeFrame(wr, frame.NextFrame)
-		if err != nil {
-			return err
-		}
-	}
-	return err
+	return n
 }
 
-type Conn struct {
-	net.Conn
-}
-
-func readFrame(rd io.Reader) (*Frame, error) {
-	var frame = &Frame{}
-	var b0 = make([]byte, 2)
-	n, err := rd.Read(b0)
-	if n != 2 {
-		return frame, ErrShortBuffer
-	}
-	if err != nil {
-		return frame, err
-	}
-	if b0[0]&0x80 == 0x80 {
-		frame.FIN = true
-	}
-	if b0[0]&0x40 == 0x40 {
-		frame.RSV[0] = true
-	}
-	if b0[0]&0x20 == 0x20 {
-		frame.RSV[1] = true
-	}
-	if b0[0]&0x10 == 0x10 {
-		frame.RSV[2] = true
-	}
-	frame.OpCode = b0[0] & 0x0f
-	if b0[1]&0x80 == 0x80 {
-		frame.Mask = true
-	}
-	if frame.OpCode == PingMessage || frame.OpCode == PongMessage {
-		var t = make([]byte, 1)
-		n, err := rd.Read(t)
-		if n != 2 {
-			return frame, ErrShortBuffer
+// decodeFrameHeader reads a frame header from rd into frame. scratch must
+// hold 8 bytes; passing it in lets the caller avoid an allocation per
+// frame.
+func decodeFrameHeader(rd io.Reader, frame *Frame, scratch []byte) error {
+	*frame = Frame{}
+	b := scratch[:2]
+	if _, err := io.ReadFull(rd, b); err != nil {
+		return err
+	}
+	frame.FIN = b[0]&0x80 != 0
+	frame.RSV = [3]bool{b[0]&0x40 != 0, b[0]&0x20 != 0, b[0]&0x10 != 0}
+	frame.OpCode = b[0] & 0x0f
+	frame.Mask = b[1]&0x80 != 0
+	switch length := b[1] & 0x7f; length {
+	case 126:
+		b = scratch[:2]
+		if _, err := io.ReadFull(rd, b); err != nil {
+			return err
 		}
-		if err != nil {
-			return frame, nil
+		frame.Length = int(binary.BigEndian.Uint16(b))
+		if frame.Length < 126 {
+			return ErrNonMinimalLength
 		}
-		return frame, nil
-	}
-	switch {
-	case b0[1]&0x7f <= 0b01111101:
-		frame.Length = int(b0[1] & 0x7f)
-	case b0[1]&0x7f == 0b01111110:
-		var t = make([]byte, 2)
-		n, err := rd.Read(t)
-		if n != 2 {
-			return frame, ErrShortBuffer
+	case 127:
+		b = scratch[:8]
+		if _, err := io.ReadFull(rd, b); err != nil {
+			return err
 		}
-		if err != nil {
-			return frame, nil
+		n := binary.BigEndian.Uint64(b)
+		if n>>63 != 0 {
+			return ErrBadLength
 		}
-		frame.Length = int(binary.BigEndian.Uint16(t))
-	case b0[1]&0x7f == 0b01111111:
-		var t = make([]byte, 8)
-		n, err := rd.Read(t)
-		if n != 2 {
-			return frame, ErrShortBuffer
+		if n < 65536 {
+			return ErrNonMinimalLength
 		}
-		if err != nil {
-			return frame, err
+		if n > math.MaxInt {
+			return ErrFrameTooBig
 		}
-		frame.Length = int(binary.BigEndian.Uint64(t))
-	}
-	var length = frame.Length
-	if frame.Mask {
-		length += 4
+		frame.Length = int(n)
+	default:
+		frame.Length = int(length)
 	}
-	var b1 = make([]byte, length)
 	if frame.Mask {
-		copy(frame.MaskingKey[:], b1[0:4])
-		frame.Payload = b1[4:]
-	} else {
-		frame.Payload = b1
-	}
-	if !frame.FIN {
-		frame.NextFrame, err = readFrame(rd)
-		if err != nil {
-			return frame, err
+		if _, err := io.ReadFull(rd, frame.MaskingKey[:]); err != nil {
+			return err
 		}
 	}
-	return frame, nil
+	return nil
 }
+
+// maxPayloadPrealloc is the largest message ReadMessage allocates up
+// front from the length in a frame header. Longer messages grow as their
+// bytes arrive, so a lying header cannot force a huge allocation.
+const maxPayloadPrealloc = 1 << 16
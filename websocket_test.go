@@ -0,0 +1,259 @@
+package websocket
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"testing"
+)
+
+// The frame helpers below encode and decode whole frames. Conn does its
+// own framing without them; the tests use them to produce and inspect
+// raw frames.
+
+// writeFrame writes frame to wr in a single Write, masking a copy of the
+// payload if needed. Length bytes of Payload are sent.
+func writeFrame(wr io.Writer, frame *Frame) error {
+	if frame.Length < 0 || frame.Length > len(frame.Payload) {
+		return ErrShortBuffer
+	}
+	var header [maxHeaderSize]byte
+	n := encodeFrameHeader(header[:], frame)
+	buf := make([]byte, n+frame.Length)
+	copy(buf, header[:n])
+	copy(buf[n:], frame.Payload[:frame.Length])
+	if frame.Mask {
+		maskBytes(frame.MaskingKey, 0, buf[n:])
+	}
+	m, err := wr.Write(buf)
+	if err != nil {
+		return err
+	}
+	if m != len(buf) {
+		return io.ErrShortWrite
+	}
+	return nil
+}
+
+func readFrameHeader(rd io.Reader) (*Frame, error) {
+	frame := &Frame{}
+	return frame, decodeFrameHeader(rd, frame, make([]byte, 8))
+}
+
+func readFramePayload(rd io.Reader, frame *Frame) error {
+	if frame.Length <= maxPayloadPrealloc {
+		frame.Payload = make([]byte, frame.Length)
+		if _, err := io.ReadFull(rd, frame.Payload); err != nil {
+			return err
+		}
+	} else {
+		var buf bytes.Buffer
+		n, err := buf.ReadFrom(io.LimitReader(rd, int64(frame.Length)))
+		if err != nil {
+			return err
+		}
+		if n < int64(frame.Length) {
+			return io.ErrUnexpectedEOF
+		}
+		frame.Payload = buf.Bytes()
+	}
+	if frame.Mask {
+		maskBytes(frame.MaskingKey, 0, frame.Payload)
+	}
+	return nil
+}
+
+func readFrame(rd io.Reader) (*Frame, error) {
+	frame, err := readFrameHeader(rd)
+	if err != nil {
+		return frame, err
+	}
+	return frame, readFramePayload(rd, frame)
+}
+
+func hello() []byte {
+	return []byte("Hello")
+}
+
+// The example frames of RFC 6455, section 5.7.
+var goldenFrames = []struct {
+	name  string
+	frame Frame
+	wire  []byte
+}{
+	{
+		"unmasked text",
+		Frame{FIN: true, OpCode: TextMessage, Length: 5, Payload: hello()},
+		[]byte{0x81, 0x05, 0x48, 0x65, 0x6c, 0x6c, 0x6f},
+	},
+	{
+		"masked text",
+		Frame{FIN: true, OpCode: TextMessage, Length: 5, Mask: true, MaskingKey: [4]byte{0x37, 0xfa, 0x21, 0x3d}, Payload: hello()},
+		[]byte{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58},
+	},
+	{
+		"first fragment",
+		Frame{OpCode: TextMessage, Length: 3, Payload: []byte("Hel")},
+		[]byte{0x01, 0x03, 0x48, 0x65, 0x6c},
+	},
+	{
+		"last fragment",
+		Frame{FIN: true, OpCode: ContinuationMessage, Length: 2, Payload: []byte("lo")},
+		[]byte{0x80, 0x02, 0x6c, 0x6f},
+	},
+	{
+		"unmasked ping",
+		Frame{FIN: true, OpCode: PingMessage, Length: 5, Payload: hello()},
+		[]byte{0x89, 0x05, 0x48, 0x65, 0x6c, 0x6c, 0x6f},
+	},
+	{
+		"masked pong",
+		Frame{FIN: true, OpCode: PongMessage, Length: 5, Mask: true, MaskingKey: [4]byte{0x37, 0xfa, 0x21, 0x3d}, Payload: hello()},
+		[]byte{0x8a, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58},
+	},
+	{
+		"256 bytes binary",
+		Frame{FIN: true, OpCode: BinaryMessage, Length: 256, Payload: bytes.Repeat([]byte{0xab}, 256)},
+		append([]byte{0x82, 0x7e, 0x01, 0x00}, bytes.Repeat([]byte{0xab}, 256)...),
+	},
+	{
+		"64KiB binary",
+		Frame{FIN: true, OpCode: BinaryMessage, Length: 65536, Payload: bytes.Repeat([]byte{0xcd}, 65536)},
+		append([]byte{0x82, 0x7f, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00}, bytes.Repeat([]byte{0xcd}, 65536)...),
+	},
+}
+
+func TestFrameGoldenVectors(t *testing.T) {
+	for _, tt := range goldenFrames {
+		t.Run(tt.name, func(t *testing.T) {
+			frame := tt.frame
+			var buf bytes.Buffer
+			if err := writeFrame(&buf, &frame); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), tt.wire) {
+				t.Fatalf("encoded % x, want % x", buf.Bytes(), tt.wire)
+			}
+			if !bytes.Equal(frame.Payload, tt.frame.Payload) {
+				t.Fatal("writeFrame masked the caller's payload")
+			}
+			got, err := readFrame(bytes.NewReader(tt.wire))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.FIN != frame.FIN || got.RSV != frame.RSV || got.OpCode != frame.OpCode || got.Length != frame.Length ||
+				got.Mask != frame.Mask || got.MaskingKey != frame.MaskingKey || !bytes.Equal(got.Payload, frame.Payload) {
+				t.Fatalf("decoded %+v", got)
+			}
+		})
+	}
+}
+
+func TestFrameLengths(t *testing.T) {
+	tests := []struct {
+		length     int
+		headerSize int
+	}{
+		{0, 2},
+		{125, 2},
+		{126, 4},
+		{65535, 4},
+		{65536, 10},
+	}
+	for _, tt := range tests {
+		for _, mask := range []bool{false, true} {
+			t.Run(strconv.Itoa(tt.length)+"/mask="+strconv.FormatBool(mask), func(t *testing.T) {
+				payload := make([]byte, tt.length)
+				for i := range payload {
+					payload[i] = byte(i)
+				}
+				frame := &Frame{FIN: true, OpCode: BinaryMessage, Length: tt.length, Mask: mask, MaskingKey: [4]byte{1, 2, 3, 4}, Payload: payload}
+				var buf bytes.Buffer
+				if err := writeFrame(&buf, frame); err != nil {
+					t.Fatal(err)
+				}
+				headerSize := tt.headerSize
+				if mask {
+					headerSize += 4
+				}
+				if buf.Len() != headerSize+tt.length {
+					t.Fatalf("wrote %d bytes, want %d", buf.Len(), headerSize+tt.length)
+				}
+				got, err := readFrame(&buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got.Length != tt.length || !bytes.Equal(got.Payload, payload) {
+					t.Fatalf("got length %d", got.Length)
+				}
+			})
+		}
+	}
+}
+
+func TestFrameHeader4GiB(t *testing.T) {
+	if strconv.IntSize < 64 {
+		t.Skip("2^32 does not fit in int")
+	}
+	var n uint64 = 1 << 32
+	wire := []byte{0x82, 0x7f, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00}
+	var header [maxHeaderSize]byte
+	size := encodeFrameHeader(header[:], &Frame{FIN: true, OpCode: BinaryMessage, Length: int(n)})
+	if !bytes.Equal(header[:size], wire) {
+		t.Fatalf("encoded % x, want % x", header[:size], wire)
+	}
+	frame, err := readFrameHeader(bytes.NewReader(wire))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uint64(frame.Length) != n {
+		t.Fatalf("decoded length %d", frame.Length)
+	}
+}
+
+func TestFrameHeaderErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		wire []byte
+		err  error
+	}{
+		{"16-bit length under 126", []byte{0x82, 0x7e, 0x00, 0x7d}, ErrNonMinimalLength},
+		{"64-bit length under 65536", []byte{0x82, 0x7f, 0, 0, 0, 0, 0, 0, 0xff, 0xff}, ErrNonMinimalLength},
+		{"64-bit length msb", []byte{0x82, 0x7f, 0x80, 0, 0, 0, 0, 0, 0, 0}, ErrBadLength},
+	}
+	for _, tt := range tests {
+		if _, err := readFrameHeader(bytes.NewReader(tt.wire)); err != tt.err {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+	}
+	if _, err := readFrame(bytes.NewReader([]byte{0x82, 0x7f, 0, 0, 0, 0, 0, 1, 0, 0, 0xff})); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated payload: got %v", err)
+	}
+	frame := &Frame{OpCode: BinaryMessage, Length: 10, Payload: make([]byte, 5)}
+	if err := writeFrame(&bytes.Buffer{}, frame); err != ErrShortBuffer {
+		t.Errorf("short payload: got %v", err)
+	}
+}
+
+func TestConnWritesGoldenFrames(t *testing.T) {
+	conn := &fuzzConn{}
+	c := newConn(conn, nil, true)
+	c.WriteMessage(TextMessage, hello())
+	c.WriteMessage(PingMessage, hello())
+	want := append(append([]byte(nil), goldenFrames[0].wire...), goldenFrames[4].wire...)
+	if !bytes.Equal(conn.written.Bytes(), want) {
+		t.Fatalf("wrote % x, want % x", conn.written.Bytes(), want)
+	}
+
+	// A client masks with a random key; unmasking must give the payload.
+	conn.written.Reset()
+	c = newConn(conn, nil, false)
+	c.WriteMessage(TextMessage, hello())
+	frame, err := readFrame(&conn.written)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !frame.Mask || frame.Length != 5 || string(frame.Payload) != "Hello" {
+		t.Fatalf("got %+v", frame)
+	}
+}